@@ -1,431 +1,6976 @@
 #!/usr/bin/env bash
 
 # Script to create a new codespace and checkout a git branch
-# Usage: ./create-codespace-and-checkout.sh [options] [branch-name]
+# Usage: ./create-codespace-and-checkout.sh [options] [branch | branch-url | owner/repo@branch]
+# Progress goes to stderr; when stdout is not a terminal, the codespace name (or the --json summary) is printed on it
 # Options:
-#   -R <repo>               Repository (default: github/github, env: REPO)
+#   -R <repo>               Repository (default: origin of the clone in the current directory, else github/github, env: REPO)
 #   -m <machine-type>       Codespace machine type (default: xLargePremiumLinux, env: CODESPACE_SIZE)
 #   -d <display-name>       Display name for codespace (48 chars max, env: CODESPACE_DISPLAY_NAME)
 #   --devcontainer-path <path>  Path to devcontainer (default: .devcontainer/devcontainer.json, env: DEVCONTAINER_PATH)
 #   --default-permissions   Use default permissions without authorization prompt
+#   --location <location>   Codespace location, or "auto" to pick the lowest-latency location
+#   --create-arg <arg>      Extra argument for gh cs create (repeatable)
+#   --create-status         Let gh cs create --status wait for the codespace instead of polling its state
+#   --branch-template <t>   Expand short branch names, e.g. {user}/{date}-{name}
+#   --issue <number|url>    Name the branch after an issue's number and title
+#   --fork <owner/repo>     Check out the -b branch from a fork, added as a remote with tracking
+#   --pr <number|url>       Check out a pull request's branch, from its fork for a contributor's pull request
+#   --sparse-checkout       Limit the checkout to the monorepo subdirectory of the detected devcontainer
+#   --push                  Push newly created branches to origin with upstream tracking
+#   --create-pr             Push a newly created branch and open a draft pull request for it
+#   --no-pull               Don't fast-forward an existing branch to origin after checking it out
+#   --no-personalization    Skip the personalization phase (terminfo, dotfiles, SSH config)
+#   --terminfo <name>       Terminfo entry to upload instead of the one for $TERM
+#   --no-terminfo           Skip the terminfo upload
+#   --terminfo-required     Fail the run when the terminfo upload fails
+#   --wait-dotfiles         Also wait for the dotfiles installation before reporting that setup is complete
+#   --wait <until>          How long to block: ready or configured (default: configured)
+#   --ready-probe <command> Command that must succeed in the workspace before the codespace counts as ready
+#   --step-retries <n>      Retry the fetch, checkout and terminfo steps up to <n> times (default: 2)
+#   --timings-out <file>    Write per-step durations, attempts and outcomes as JSON to <file> when the run ends
+#   --log-file <file>       Append a debug log of the run (every command and its captured output) to <file>
+#   --theme <dark|light>    Output colors for dark or light terminal backgrounds (default: dark)
+#   --plain                 Plain ASCII output: INFO/WARN/ERROR/STEP tagged lines, no colors or spinners
+#   --no-wait               Don't wait for configuration to complete (same as --wait ready)
+#   --log-filter <regex>    Only show configuration log lines matching <regex>
+#   --notify                Show a desktop notification when setup completes or fails
+#   --quiet-progress        No spinners or per-attempt lines: one line per phase plus a periodic heartbeat
+#   --stack-on <parent>     Create/checkout the branch on top of a parent branch (stacked PRs)
+#   --base <ref>            Create new branches from this ref (e.g. origin/main) instead of the initial HEAD
+#   --new-branch-from <ref> Like --base, for a tag or commit SHA, which is fetched first when the clone lacks it
+#   --ref <tag|sha>         Check out a tag or commit with a detached HEAD instead of a branch
+#   --worktree              Check out the branch in a new worktree at /workspaces/<repo>-<branch>
+#   --sync-diff             Apply the uncommitted changes of the local clone in the codespace after checkout
+#   --copy <local>:<remote> Copy a local file or directory into the codespace (repeatable)
+#   --run <command>         Run a command in the workspace after setup (repeatable)
+#   --workdir <path>        Workspace subdirectory for --run, post-checkout hooks and SSH sessions
+#   --secret <name>=<value> Create/update a Codespaces user secret for the repository before creation (repeatable)
+#   --secrets-from-file <f> Read --secret NAME=VALUE lines from a dotenv-style file
+#   --forward-ports <ports> Forward ports (<remote>[:<local>],...) to localhost in the background after setup
+#   --json                  Print a JSON summary (including the cost estimate) on stdout when setup completes
+#   --print-name            Print only the codespace name on stdout when setup completes
+#   --output ndjson         Stream one JSON object per pipeline event on stdout
+#   --command-timeout <s>   Stop a single gh call after this many seconds, 0 for no limit (default: 300)
+#   --bug-report            Write a sanitized diagnostics report at the end of the run
+#   --auto-gc               Delete codespaces that break the configured retention policy
+#   --cleanup-on-failure    Delete the new codespace when a later step fails
+#   --dry-run               Print the gh and remote commands instead of running them
+#   --open <target>         Open the codespace when setup completes: vscode, web, jetbrains, ssh or none (default: none)
+#   --connect               Open an SSH session when setup completes (same as --open ssh)
+#   --detach                Return once the codespace is created and finish the setup in the background
+#   --codespace <name>      Continue the setup of an existing codespace instead of creating one
+#   --delete-oldest         At the codespace limit, delete the least recently used codespace and retry
+#   --require-prebuild      Abort instead of creating a codespace that has no prebuild to start from
+#   --branches <a,b,...>    Create a codespace per branch, several at a time (see --parallel)
+#   --branches-file <file>  Like --branches, with one branch per line in <file> ("-" for stdin)
+#   --parallel <n>          Number of codespaces --branches sets up at the same time (default: 3)
+#   --session-recording     Record the SSH session with script(1) inside the codespace
+#
+# The script can also be sourced to reuse the codespace_* workflow steps from other tools;
+# main only runs when the script is executed directly.
 
 # set -e  # Exit on any error
 
+# Distribution profile
+# Platform teams can ship a tailored build without forking the script: the release workflow
+# replaces the values in this block with the DIST_* lines of a distribution.env file.
+# BEGIN DISTRIBUTION
+DIST_NAME="create-codespace-and-checkout"
+DIST_DEFAULT_REPO="github/github"
+DIST_DEFAULT_HOST="github.com"
+DIST_POLICY_URL=""
+DIST_RELEASE_REPO="github.com/ekroon/create-codespace-and-checkout"
+# END DISTRIBUTION
+
 # Signal handler for clean exit on CTRL-C (SIGINT) and SIGTERM
+# When a codespace was already created, its state is saved and (interactively) deletion is offered
 cleanup_on_exit() {
+  # A second interrupt while handling the first exits immediately
+  trap 'exit 130' SIGINT SIGTERM
+  CANCEL_REASON=interrupted
+
   echo ""
   echo "Interrupted. Exiting..."
+
+  if [ -n "${CODESPACE_NAME:-}" ]; then
+    echo "Codespace '$CODESPACE_NAME' was interrupted during the '${CURRENT_STEP:-unknown}' step"
+    if _state_save "interrupted"; then
+      echo "State saved to $STATE_DIR/codespaces/$CODESPACE_NAME"
+    fi
+
+    if [ "$IMMEDIATE_MODE" = false ] && [ -t 0 ] &&
+      mise x ubi:charmbracelet/gum -- gum confirm --default=false "Delete codespace '$CODESPACE_NAME'?"; then
+      if _with_timeout "$GH" cs delete -c "$CODESPACE_NAME" --force >/dev/null 2>&1; then
+        rm -f "$STATE_DIR/codespaces/$CODESPACE_NAME"
+        echo "Deleted codespace '$CODESPACE_NAME'"
+      else
+        echo "Failed to delete codespace '$CODESPACE_NAME', delete it with: gh cs delete -c $CODESPACE_NAME"
+      fi
+    else
+      echo "Resume with: $PROG resume $CODESPACE_NAME"
+      echo "Connect with: gh cs ssh -c $CODESPACE_NAME"
+      echo "Delete with: gh cs delete -c $CODESPACE_NAME"
+    fi
+  fi
+
   exit 130
 }
 
-# Trap SIGINT (CTRL-C) and SIGTERM
-trap cleanup_on_exit SIGINT SIGTERM
-
 # Function to show help/usage information (defined early so it can be called before dependency checks)
 show_help() {
   cat <<EOF
-Usage: ./create-codespace-and-checkout.sh [options]
+Usage: $PROG [command] [options] [branch | branch-url | owner/repo@branch]
+
+$DIST_NAME: create a GitHub Codespace and optionally checkout a git branch.
 
-Create a GitHub Codespace and optionally checkout a git branch.
+Commands:
+  exec-all                     Run a command in all of your codespaces for a repository (see exec-all --help)
+  batch                        Create codespaces for a list of repositories, also across GitHub hosts (see batch --help)
+  wait                         Wait until an existing codespace is ready, configured, ... (see wait --help)
+  status                       Run the readiness checks once for an existing codespace (see status --help)
+  worktree                     List, add or remove branch worktrees in an existing codespace (see worktree --help)
+  resume                       Continue the setup of a codespace whose run failed or was interrupted (see resume --help)
+  history                      List past runs: repository, branch, codespace and outcome (see history --help)
+  monitor                      Notify when codespaces created by this tool stop, idle or are deleted (see monitor --help)
+  telemetry                    Show, enable or disable the opt-in usage telemetry (see telemetry --help)
+  stats                        Summarize the locally recorded telemetry of past runs
+  completion                   Print a shell completion script for bash, zsh, fish or PowerShell (see completion --help)
+  version                      Print the version, commit and build date of this script and the gh version (also --version)
+  doctor                       Check the local setup (gh, login and scopes, mise, network, config file) and suggest fixes
+  upgrade                      Replace this script with the latest release after verifying its checksum (see upgrade --help)
 
 Options:
-  -b <branch>                  Branch name to checkout (optional, if not provided uses default branch)
-  -R <repo>                    Repository (default: github/github, env: REPO)
+  -b <branch>                  Branch name to checkout (optional, if not provided uses default branch); a bare
+                               branch name without '/' can also be given as the argument
+  --branch-template <template> Expand a new branch name without '/' with {user} (GitHub login), {date}
+                               (YYYY-MM-DD) and {name}, e.g. {user}/{date}-{name} (config: branch.template)
+  --issue <number|url>         Name the branch after an issue: its number and title as issue.branch_template
+                               in the config file says (default: {number}-{slug})
+  --fork <owner/repo>          The -b branch lives on this fork: add it as a remote named after its owner, fetch
+                               the branch and check it out tracking the fork
+  --pr <number|url>            Check out the head branch of a pull request, from its fork (as with --fork) when
+                               it comes from one
+  --branches <a,b,...>         Create and set up a codespace for each of these comma-separated branches
+                               concurrently, with output prefixed by branch and a per-branch summary
+  --branches-file <file>       Like --branches, with one branch per line in <file>, or on stdin for "-"
+                               (the JSON of gh pr list --json headRefName is accepted too)
+  --parallel <n>               Number of codespaces --branches sets up at the same time (default: 3,
+                               1 to set them up one after another)
+  -R <repo>                    Repository (default: the origin remote of the git clone in the current
+                               directory, else $DIST_DEFAULT_REPO, env: REPO); also HOST/OWNER/REPO or
+                               a repository URL (https://github.com/owner/repo, git@github.com:owner/repo.git)
   -m <machine-type>            Codespace machine type (default: xLargePremiumLinux, env: CODESPACE_SIZE)
   -d <display-name>            Display name for the codespace (48 characters or less, env: CODESPACE_DISPLAY_NAME)
   --devcontainer-path <path>   Path to devcontainer (default: .devcontainer/devcontainer.json, env: DEVCONTAINER_PATH)
   --default-permissions        Use default permissions without authorization prompt
+  --location <location>        Location for the codespace (EastUs, SouthEastAsia, WestEurope, WestUs2), or
+                               "auto" to probe the latency to each location and pick the fastest
+  --create-arg <arg>           Append a raw argument to gh cs create, for options this script doesn't wrap yet,
+                               e.g. --create-arg --idle-timeout=30m (repeatable)
+  --create-status              Run gh cs create --status, which blocks until the codespace is available, and
+                               skip polling its state (config: create.status = true)
+  --stack-on <parent-branch>   Check out (or create) the parent branch first and create the branch on top of it,
+                               recording the relationship in the branch description (requires -b)
+  --base <ref>                 Create a branch that doesn't exist yet from <ref> (e.g. origin/main, a tag or
+                               a commit) after fetching, instead of the HEAD the codespace starts on (requires -b)
+  --new-branch-from <ref>      Same as --base, for a tag or a full commit SHA; one the clone doesn't have yet is
+                               fetched from origin first (requires -b)
+  --ref <tag|sha>              Check out a tag or commit with a detached HEAD instead of a branch, fetching it
+                               from origin when needed (cannot be combined with -b, --issue or --worktree)
+  --worktree                   Check out the branch in a new git worktree at /workspaces/<repo>-<branch> instead
+                               of switching the main checkout (requires -b; manage them with the worktree command)
+  --sync-diff                  When run from a local clone of the repository, apply its uncommitted (staged
+                               and unstaged) changes in the codespace after the branch is checked out
+  --copy <local>:<remote>      Copy a local file or directory into the codespace once it is ready (repeatable);
+                               relative remote paths are relative to the home directory in the codespace
+  --run <command>              Run a shell command in the workspace directory once the branch is checked out
+                               and configuration finished, streaming its output (repeatable, runs in order)
+  --workdir <path>             Subdirectory of the workspace (e.g. services/foo) where --run commands and
+                               post-checkout hooks run and SSH sessions start
+  --secret <name>[=<value>]    Create or update a Codespaces user secret and give the repository access to it
+                               before the codespace is created, so the devcontainer build can use it
+                               (repeatable; without =<value> the value comes from the environment variable)
+  --secrets-from-file <file>   Set the NAME=VALUE secrets in a dotenv-style file (e.g. .env.codespaces)
+  --forward-ports <ports>      Forward codespace ports to localhost in the background once configuration
+                               completes, e.g. 3000,8080:80 (<remote>[:<local>], as in gh cs ports forward)
+  --json                       Print a JSON summary of the result, including the cost estimate, on stdout
+                               when setup completes (all other output goes to stderr)
+  --print-name                 Print exactly one line, the codespace name, on stdout when setup completes
+                               (also printed without this flag when stdout is not a terminal)
+  --output ndjson              Stream one JSON object per event (step_started, attempt, step_finished, info,
+                               warning, error, result) on stdout as the run progresses
+  --command-timeout <seconds>  Stop a gh call (API request, SSH command, ...) that runs longer than this, 0 for
+                               no limit (default: 300, config: timeout.command). Interactive sessions, --run
+                               commands and hooks are not limited
+  --bug-report                 Write a sanitized markdown report (versions, config, codespace state, transcript)
+                               to the current directory when the run ends, regardless of outcome
+  --auto-gc                    Delete codespaces that break the retention policy in the config file
+                               (without it, they are only listed at the end of the run)
+  --cleanup-on-failure         Delete the newly created codespace when a later step (readiness, fetch,
+                               checkout, configuration) fails, instead of leaving it running
+  --dry-run                    Print every gh invocation and remote command the run would execute
+                               without executing anything (a placeholder codespace name is used)
+  --open <target>              Open the codespace when setup completes: vscode (gh cs code), web (browser
+                               editor), jetbrains (JetBrains Gateway over SSH), ssh (interactive session)
+                               or none (default: none)
+  --connect                    Open an SSH session in the codespace when setup completes (same as --open ssh)
+  --detach                     Return as soon as the codespace is created and finish the setup (fetch,
+                               checkout, configuration, ...) in the background, logging to
+                               ~/.local/state/create-codespace-and-checkout/logs/<codespace>.log
+  --codespace <name>           Continue the setup of an existing codespace instead of creating one
+                               (implies -x; the repository is looked up when -R is not given)
+  --delete-oldest              When the account has reached its maximum number of codespaces, delete the least
+                               recently used one and retry (interactively, you pick one from a list instead)
+  --require-prebuild           Don't create a codespace without a prebuild for the machine type and location:
+                               wait for a prebuild that is still being built, abort when there is none
+  --sparse-checkout            When run from a monorepo subdirectory with its own devcontainer configuration,
+                               limit the codespace checkout to that subdirectory (git sparse-checkout)
+  --push                       Push a newly created branch with git push -u origin <branch> so it is visible
+                               to teammates right away (with --stack-on, a new parent branch is pushed too)
+  --create-pr                  Push a newly created branch and open a draft pull request for it (against the
+                               --stack-on parent or the default branch); config: pr.title, pr.body templates
+  --pull, --no-pull            Fast-forward an existing branch with git pull --ff-only after checking it out
+                               and report the number of new commits (default: --pull)
+  --no-personalization         Skip the personalization phase: terminfo upload, dotfiles copy and SSH config
+                               (config: personalization.files, personalization.ssh_config_dir)
+  --terminfo <name>            Upload this terminfo entry instead of the one for \$TERM, even when it is a
+                               standard entry (xterm-256color, screen, tmux-256color, ...) that is normally skipped
+  --no-terminfo                Skip the terminfo upload
+  --terminfo-required          Fail the run when the terminfo upload fails instead of only warning
+  --wait-dotfiles              After configuration, also wait until your dotfiles repository is cloned and its
+                               install script finished (config: dotfiles.wait, dotfiles.marker)
+  --wait <until>               How long to block: ready (the codespace is available and the branch checked out)
+                               or configured (the devcontainer configuration finished too; default)
+  --no-wait                    Don't wait for configuration to complete (same as --wait ready)
+  --ready-probe <command>      Shell command that must succeed in the workspace folder before the codespace
+                               counts as ready, e.g. a tool or service check (config: ready.probe,
+                               ready.probe_attempts, ready.probe_interval)
+  --step-retries <n>           Retry the fetch, checkout and terminfo steps up to <n> times with exponential
+                               backoff when they fail, e.g. on an SSH hiccup (default: 2; config:
+                               retry.<step>.retries, retry.<step>.backoff)
+  --timings-out <file>         Write the duration, attempts and outcome of every step as JSON to <file> when
+                               the run ends, to aggregate codespace startup performance across runs
+  --log-file <file>            Append a debug log of the run to <file>: every command the script runs with its
+                               arguments and captured output, and every message, redacted like the console
+                               output (config: log.auto = true logs every run to the state directory)
+  --theme <dark|light>         Output colors for dark (default) or light terminal backgrounds (config:
+                               theme.preset, theme.<element> colors, theme.symbols = false)
+  --plain                      Plain ASCII output for screen readers and log collectors: no colors, symbols
+                               or spinners, every line starts with INFO, WARN, ERROR or STEP (config:
+                               output.plain = true)
+  --log-filter <regex>         Only show the configuration log lines matching <regex> (an extended regular
+                               expression) while waiting for configuration; all lines are shown by default
+  --notify                     Show a desktop notification with the codespace name and connect command when
+                               setup completes or fails (config: notify.desktop)
+  --quiet-progress             Print one line per phase transition and a heartbeat every few minutes instead
+                               of spinners and per-attempt lines (config: quiet_progress.heartbeat_minutes)
+  --session-recording          Record the SSH session with script(1), storing the transcript inside
+                               the codespace (config: session_recording.dir, session_recording.enabled)
   -x, --immediate              Skip interactive prompts for unspecified options (use defaults)
+  --version                    Print version information and exit
   -h, --help                   Show this help message and exit
 
+Exit codes:
+  0                            Setup complete
+  1                            Invalid input or another failure
+  10                           Creating the codespace failed (pre-create hooks, billing, prebuild, secrets,
+                               gh cs create)
+  11                           The codespace or its workspace folder did not become available
+  12                           Fetching failed, usually because git authentication wasn't ready yet
+  13                           The branch could not be checked out
+  14                           The codespace failed while configuring
+  15                           Setup finished, but configuration did not complete in time
+  130                          Cancelled at a prompt or interrupted
+
 Environment Variables:
   REPO                         Override default repository
   CODESPACE_SIZE              Override default machine type
   CODESPACE_DISPLAY_NAME      Override display name for codespace
   DEVCONTAINER_PATH           Override default devcontainer path
+  CODESPACE_CONFIG            Config file (default: ~/.config/create-codespace-and-checkout/config)
+  GH_HOST, GH_TOKEN           Passed on to gh, which makes every GitHub call (also when run as a gh extension)
+  CODESPACE_GH                The gh executable to run instead of the one on the PATH (e.g. a scripted fake)
   GUM_LOG_*                   Customize log formatting (see gum log documentation)
 
 Examples:
-  ./create-codespace-and-checkout.sh -b my-branch
-  ./create-codespace-and-checkout.sh -R myorg/myrepo -m large -b my-branch
-  ./create-codespace-and-checkout.sh -d "my-feature-work" -b my-branch
-  ./create-codespace-and-checkout.sh -x -b my-branch  # Skip interactive prompts
-  ./create-codespace-and-checkout.sh  # Interactive mode, branch optional
-  REPO=myorg/myrepo ./create-codespace-and-checkout.sh -x  # Use defaults, no branch checkout
+  $PROG -b my-branch
+  $PROG -R myorg/myrepo -m large -b my-branch
+  $PROG -d "my-feature-work" -b my-branch
+  $PROG -x -b my-branch  # Skip interactive prompts
+  $PROG -x https://github.com/myorg/myrepo/tree/my-branch  # Repo and branch from a URL
+  $PROG -x myorg/myrepo@my-branch  # Repo and branch shorthand
+  $PROG  # Interactive mode, branch optional
+  REPO=myorg/myrepo $PROG -x  # Use defaults, no branch checkout
 EOF
   exit 0
 }
 
-# Check for help option first (before dependency checks)
-for arg in "$@"; do
-  if [ "$arg" = "-h" ] || [ "$arg" = "--help" ]; then
-    show_help
-  fi
-done
+show_exec_all_help() {
+  cat <<EOF
+Usage: $PROG exec-all [-R <repo>] -- <command> [args...]
 
-# Check for required dependencies
-MISSING_DEPS=()
+Run a command concurrently in all of your codespaces for a repository. Output is
+prefixed with the codespace name and a result table is printed at the end.
+Stopped codespaces are started by the SSH connection.
 
-if ! command -v gh >/dev/null 2>&1; then
-  MISSING_DEPS+=("gh")
-fi
+Options:
+  -R <repo>                    Repository (default: the origin remote of the git clone in the current
+                               directory, else $DIST_DEFAULT_REPO, env: REPO)
+  -h, --help                   Show this help message and exit
 
-if ! command -v mise >/dev/null 2>&1; then
-  MISSING_DEPS+=("mise")
-fi
+Examples:
+  $PROG exec-all -R myorg/myrepo -- git pull --ff-only
+  $PROG exec-all -R myorg/myrepo -- script/clean-caches
+EOF
+  exit 0
+}
 
-if ! command -v infocmp >/dev/null 2>&1; then
-  MISSING_DEPS+=("infocmp")
-fi
+show_batch_help() {
+  cat <<EOF
+Usage: $PROG batch [--file <file>] [options]
 
-if [ ${#MISSING_DEPS[@]} -ne 0 ]; then
-  echo "[ERROR] Missing required dependencies: ${MISSING_DEPS[*]}"
-  exit 1
-fi
+Create a codespace for every line of a batch file (or stdin), one after another, in
+immediate mode. Each line is "<repo> [branch]"; blank lines and lines starting with #
+are ignored. A repo written as HOST/OWNER/REPO is created on that GitHub host (for
+example a GitHub Enterprise Server), using the gh login for that host, so github.com
+and other hosts can be mixed in one file. Other options are passed to every item.
 
-# Helper function to set gum log style defaults
-_gum_set_default() {
-  # $1 = var name, $2 = default value
-  if [ -z "${!1+x}" ]; then
-    export "$1=$2"
-  fi
-}
+Options:
+  --file <file>                Batch file (default: stdin)
+  -h, --help                   Show this help message and exit
 
-# Set default gum log styling (can be overridden via environment)
-_gum_set_default GUM_LOG_LEVEL_FOREGROUND 212
-_gum_set_default GUM_LOG_LEVEL_BOLD true
-_gum_set_default GUM_LOG_TIME_FOREGROUND 244
-_gum_set_default GUM_LOG_MESSAGE_FOREGROUND 254
-_gum_set_default GUM_LOG_KEY_FOREGROUND 240
-_gum_set_default GUM_LOG_VALUE_FOREGROUND 118
-_gum_set_default GUM_LOG_SEPARATOR_FOREGROUND 240
+Example batch file:
+  myorg/web feature-x
+  ghes.example.com/platform/api
+  ghes.example.com/platform/worker fix-queue
 
-# Function to print status messages using gum log with structured formatting
-print_status() {
-  mise x ubi:charmbracelet/gum -- gum log --structured --level info --time rfc822 "$1"
+Examples:
+  $PROG batch --file codespaces.txt
+  $PROG batch --file codespaces.txt -m largePremiumLinux --push
+EOF
+  exit 0
 }
 
-print_warning() {
-  mise x ubi:charmbracelet/gum -- gum log --structured --level warn --time rfc822 "$1"
-}
+show_wait_help() {
+  cat <<EOF
+Usage: $PROG wait <codespace> [--for <condition>]...
 
-print_error() {
-  mise x ubi:charmbracelet/gum -- gum log --structured --level error --time rfc822 "$1"
-}
+Wait for an existing codespace (created by any means) using the same polling and
+log parsing as the create flow. Conditions are checked in the order given.
 
-# Require Bash 4.0+ for associative arrays (check early, before gum usage)
-if [ -z "${BASH_VERSINFO[0]:-}" ] || [ "${BASH_VERSINFO[0]}" -lt 4 ]; then
-  current_bash=$(command -v bash)
-  echo "[ERROR] Bash 4.0+ is required (detected ${BASH_VERSINFO[0]:-unknown}.${BASH_VERSINFO[1]:-unknown} at ${current_bash:-unknown})." >&2
-  echo "[ERROR] Install a newer bash and ensure it is first in PATH." >&2
-  exit 1
-fi
+Conditions:
+  ready                        Codespace is Available and its workspace directory exists (default)
+  configured                   Codespace configuration has finished
+  dotfiles                     Your dotfiles repository was cloned and installed (or dotfiles.marker exists)
+  port:<port>                  Something listens on <port> inside the codespace
+  cmd:<command>                <command> succeeds when run in the workspace directory (or --workdir)
 
-# Fetch available machine types for a repository
-# Usage: _fetch_machine_types <repo>
-# Returns machine types as tab-separated "name\tdisplay_name" pairs, or empty on failure
-_fetch_machine_types() {
-  local repo=$1
-  gh api "/repos/$repo/codespaces/machines" --jq '.machines[] | "\(.name)\t\(.display_name)"' 2>/dev/null
+Options:
+  --for <condition>            Condition to wait for (repeatable)
+  --workdir <path>             Run cmd: conditions in this subdirectory of the workspace
+  -h, --help                   Show this help message and exit
+
+Examples:
+  $PROG wait my-codespace-abc123 --for configured
+  $PROG wait my-codespace-abc123 --for ready --for port:3000
+  $PROG wait my-codespace-abc123 --for "cmd:test -f tmp/bootstrapped"
+EOF
+  exit 0
 }
 
-declare -A DISPLAY_BY_NAME
-declare -A NAME_BY_DISPLAY
-declare -a DISPLAY_NAMES
+show_status_help() {
+  cat <<EOF
+Usage: $PROG status <codespace>
 
-# Parse machine types into lookup maps and ordered display list
-# Usage: _parse_machine_types <machine_types>
-_parse_machine_types() {
-  local machine_types=$1
-  local name
-  local display_name
+Run the readiness checks of the create flow once and print a diagnostic table, for
+example after a run timed out. The exit code is non-zero when a check failed.
 
-  DISPLAY_BY_NAME=()
-  NAME_BY_DISPLAY=()
-  DISPLAY_NAMES=()
+Checks:
+  state                        The codespace is Available according to the API
+  workspace                    The workspace folder exists (/workspaces/<repo> or workspaceFolder)
+  git auth                     git can reach origin from the workspace (git ls-remote)
+  configuration                The codespace logs end with "Finished configuring codespace."
 
-  while IFS=$'\t' read -r name display_name; do
-    [ -z "$name" ] && continue
-    DISPLAY_BY_NAME["$name"]="$display_name"
-    NAME_BY_DISPLAY["$display_name"]="$name"
-    DISPLAY_NAMES+=("$display_name")
-  done <<<"$machine_types"
+Options:
+  -h, --help                   Show this help message and exit
+
+Examples:
+  $PROG status my-codespace-abc123
+EOF
+  exit 0
 }
 
-# Choose machine type display name with optional preselect
-# Usage: _gum_choose_machine_type <default_display_name>
-_gum_choose_machine_type() {
-  local default_display_name=$1
-  local choose_args=(--header "Select machine type:")
+show_resume_help() {
+  cat <<EOF
+Usage: $PROG resume <codespace> [options]
 
-  if [ -n "$default_display_name" ]; then
-    choose_args+=(--selected "$default_display_name")
-  fi
+Continue the setup of a codespace whose run failed, was interrupted or detached, instead of
+starting over with a new codespace. The repository, branch, machine type and devcontainer
+path are read from the state file of the earlier run ($STATE_DIR/codespaces/<codespace>),
+and the steps that already completed are skipped: the run picks up at the step it stopped in.
 
-  mise x ubi:charmbracelet/gum -- gum choose "${choose_args[@]}"
-}
+Options of the create flow (--run, --forward-ports, --open, ...) can be added; they apply to
+the resumed run.
 
-# Generic retry function for waiting on conditions
-# Usage: retry_until <max_attempts> <sleep_seconds> <description> <command>
-retry_until() {
-  local max_attempts=$1
-  local sleep_seconds=$2
-  local description=$3
-  shift 3
-  local command=("$@")
+Options:
+  -h, --help                   Show this help message and exit
 
-  local attempt=1
-  while [ $attempt -le "$max_attempts" ]; do
-    print_status "$description (attempt $attempt/$max_attempts)..."
+Examples:
+  $PROG resume my-codespace-abc123
+  $PROG resume my-codespace-abc123 --connect
+EOF
+  exit 0
+}
 
-    if "${command[@]}" >/dev/null 2>&1; then
-      return 0
-    fi
+show_history_help() {
+  cat <<EOF
+Usage: $PROG history [options]
 
-    if [ $attempt -eq "$max_attempts" ]; then
-      return 1
-    fi
+List the create runs recorded on this machine, most recent first: when they ran, how
+they ended (complete, detached, cancelled or failed), the repository, branch, codespace
+and the step a run ended in. Runs are kept in $STATE_DIR/history.tsv.
 
-    sleep "$sleep_seconds"
-    attempt=$((attempt + 1))
-  done
+Options:
+  --repo <owner/repo>          Only show runs for this repository
+  --branch <branch>            Only show runs for this branch
+  --codespace <name>           Only show runs for this codespace
+  --limit <n>                  Show at most <n> runs (default: 20)
+  --json                       Print the runs as a JSON array
+  -h, --help                   Show this help message and exit
+
+Examples:
+  $PROG history
+  $PROG history --branch my-branch  # Which codespace was that branch?
+EOF
+  exit 0
 }
 
-# Set defaults from environment variables or use built-in defaults
-DEFAULT_MACHINE_TYPE="xLargePremiumLinux"
-REPO=${REPO:-"github/github"}
-CODESPACE_SIZE=${CODESPACE_SIZE:-"$DEFAULT_MACHINE_TYPE"}
-DEVCONTAINER_PATH=${DEVCONTAINER_PATH:-".devcontainer/devcontainer.json"}
-DISPLAY_NAME=${CODESPACE_DISPLAY_NAME:-""}
-DEFAULT_PERMISSIONS=""
-BRANCH_NAME=""
-IMMEDIATE_MODE=false
+show_worktree_help() {
+  cat <<EOF
+Usage: $PROG worktree <codespace> [list]
+       $PROG worktree <codespace> add <branch> [--base <ref>]
+       $PROG worktree <codespace> remove <branch>|--all [--force]
 
-# Parse command line arguments
-while [[ $# -gt 0 ]]; do
-  case $1 in
-  -h | --help)
-    show_help
-    ;;
-  -b)
-    BRANCH_NAME="$2"
-    shift 2
-    ;;
-  -R)
-    REPO="$2"
-    shift 2
-    ;;
-  -m)
-    CODESPACE_SIZE="$2"
-    shift 2
-    ;;
-  -d)
-    DISPLAY_NAME="$2"
-    shift 2
-    ;;
-  --devcontainer-path)
-    DEVCONTAINER_PATH="$2"
-    shift 2
-    ;;
-  --default-permissions)
-    DEFAULT_PERMISSIONS="--default-permissions"
-    shift
-    ;;
-  -x | --immediate)
-    IMMEDIATE_MODE=true
-    shift
-    ;;
-  -*)
-    print_error "Unknown option: $1"
-    echo "Use --help to see available options"
-    exit 1
-    ;;
-  *)
-    print_error "Unexpected argument: $1"
-    echo "Use -b <branch> to specify a branch name"
-    echo "Use --help to see available options"
-    exit 1
-    ;;
-  esac
-done
+Manage the branch worktrees that --worktree creates at /workspaces/<repo>-<branch>, so
+one codespace can have several branches checked out at the same time.
 
-# Extract repository name from REPO (e.g., "github/github" -> "github")
-REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+Actions:
+  list                         List the worktrees created with --worktree (default)
+  add <branch>                 Add a worktree for <branch>, checked out from origin or created
+  remove <branch>              Remove the worktree of <branch> (the branch itself is kept)
 
-# Interactive mode: prompt for unspecified options unless immediate mode is enabled
-if [ "$IMMEDIATE_MODE" = false ]; then
-  # Prompt for repository if not specified
-  if [ "$REPO" = "github/github" ]; then
-    REPO_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Repository: " --placeholder "github/github") || exit 130
-    if [ -n "$REPO_INPUT" ]; then
-      REPO="$REPO_INPUT"
-      REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
-    fi
-  fi
+Options:
+  --base <ref>                 With add: create a new branch from <ref> instead of the main checkout's HEAD
+  --all                        With remove: remove all worktrees created with --worktree
+  --force                      With remove: also remove worktrees with uncommitted changes
+  -h, --help                   Show this help message and exit
 
-  # Prompt for machine type if not specified
-  if [ "$CODESPACE_SIZE" = "$DEFAULT_MACHINE_TYPE" ]; then
-    MACHINE_TYPES=$(_fetch_machine_types "$REPO")
-    if [ -n "$MACHINE_TYPES" ]; then
-      _parse_machine_types "$MACHINE_TYPES"
-      DEFAULT_DISPLAY_NAME=${DISPLAY_BY_NAME[$DEFAULT_MACHINE_TYPE]}
+Examples:
+  $PROG worktree my-codespace-abc123
+  $PROG worktree my-codespace-abc123 add fix-login --base origin/main
+  $PROG worktree my-codespace-abc123 remove --all
+EOF
+  exit 0
+}
 
-      SELECTED_DISPLAY_NAME=$(printf '%s\n' "${DISPLAY_NAMES[@]}" | _gum_choose_machine_type "$DEFAULT_DISPLAY_NAME") || exit 130
-      CODESPACE_SIZE=${NAME_BY_DISPLAY[$SELECTED_DISPLAY_NAME]}
-    else
-      # Fallback to text input if API call fails
-      print_warning "Could not fetch machine types from API, using text input"
-      CODESPACE_SIZE_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Machine type: " --placeholder "$DEFAULT_MACHINE_TYPE") || exit 130
-      if [ -n "$CODESPACE_SIZE_INPUT" ]; then
-        CODESPACE_SIZE="$CODESPACE_SIZE_INPUT"
-      fi
-    fi
-  fi
+show_monitor_help() {
+  cat <<EOF
+Usage: $PROG monitor [--interval <seconds>] [--idle-hours <hours>] [--once]
 
-  # Prompt for devcontainer path if not specified
-  if [ "$DEVCONTAINER_PATH" = ".devcontainer/devcontainer.json" ]; then
-    DEVCONTAINER_PATH_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Devcontainer path: " --placeholder ".devcontainer/devcontainer.json") || exit 130
-    if [ -n "$DEVCONTAINER_PATH_INPUT" ]; then
-      DEVCONTAINER_PATH="$DEVCONTAINER_PATH_INPUT"
-    fi
-  fi
+Poll the codespaces created by this tool and send lifecycle events to the notifier
+sinks in the config file (notify.webhook, notify.command):
+  stopped                      The codespace shut down
+  deleted                      The codespace no longer exists (it is no longer tracked)
+  idle                         The codespace has been running for <hours> since it was last used
 
-  # Prompt for branch name if not specified (optional)
-  # Note: Branch name is prompted before display name so we can use it as default
-  if [ -z "$BRANCH_NAME" ]; then
-    BRANCH_NAME=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Branch name (optional): " --placeholder "Leave empty to skip checkout") || exit 130
-  fi
+Options:
+  --interval <seconds>         Time between polls (default: 300)
+  --idle-hours <hours>         Hours before an idle event (default: 4, config: monitor.idle_hours)
+  --once                       Poll once and exit (for cron or systemd timers)
+  -h, --help                   Show this help message and exit
 
-  # Prompt for display name if not specified (optional)
-  # Default to branch name (truncated to 48 chars) if branch is set
-  if [ -z "$DISPLAY_NAME" ]; then
-    default_display_name=""
-    if [ -n "$BRANCH_NAME" ]; then
-      default_display_name="${BRANCH_NAME:0:48}"
-    fi
-    DISPLAY_NAME=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Display name (optional): " --value "$default_display_name" --placeholder "Leave empty for auto-generated name") || exit 130
-  fi
-fi
+Polls are spread evenly over the interval and never exceed api.requests_per_minute
+(config, default: 60), a budget shared with the other runs of the tool, so many
+codespaces don't burst against the API rate limit.
 
-# Auto-set display name from branch name when not specified
-# This applies to both immediate mode and when branch was provided via -b flag
-if [ -z "$DISPLAY_NAME" ] && [ -n "$BRANCH_NAME" ]; then
-  DISPLAY_NAME="${BRANCH_NAME:0:48}"
-fi
+Examples:
+  $PROG monitor
+  $PROG monitor --once --idle-hours 2
+EOF
+  exit 0
+}
 
-# Branch name is optional - if not provided, skip checkout step
+show_telemetry_help() {
+  cat <<EOF
+Usage: $PROG telemetry [status|enable|disable]
 
-print_status "Starting codespace creation process..."
+Usage telemetry is off unless you enable it. Each run then records phase durations, the
+features used, the machine type, the result and the cancellation reason; repository and
+branch names are only included with telemetry.include_names = true in the config file.
+Records are kept locally for the stats command and, when telemetry.endpoint is set in the
+config file, also sent there (for example a collector run by your team).
 
-# Step 1: Create the codespace and capture the output
-# Build display name flag conditionally
-DISPLAY_NAME_FLAG=()
-if [ -n "$DISPLAY_NAME" ]; then
-  DISPLAY_NAME_FLAG=("--display-name" "$DISPLAY_NAME")
-fi
+Commands:
+  status                       Show whether telemetry is enabled and where records go (default)
+  enable                       Set telemetry.enabled = true in the config file
+  disable                      Set telemetry.enabled = false in the config file
+  -h, --help                   Show this help message and exit
+EOF
+  exit 0
+}
 
-print_status "Creating new codespace with $CODESPACE_SIZE machine type..."
-if ! CODESPACE_OUTPUT=$(gh cs create -R "$REPO" -m "$CODESPACE_SIZE" --devcontainer-path "$DEVCONTAINER_PATH" "${DISPLAY_NAME_FLAG[@]}" $DEFAULT_PERMISSIONS 2>&1); then
-  # Check if the failure is due to permissions authorization required
-  if echo "$CODESPACE_OUTPUT" | grep -q "You must authorize or deny additional permissions"; then
-    print_error "Codespace creation requires additional permissions authorization"
-    print_error "Please authorize the permissions in your browser, then try again"
-    # Extract and display the authorization URL if present
-    AUTH_URL=$(echo "$CODESPACE_OUTPUT" | grep -o "https://github\.com/[^[:space:]]*")
-    if [ -n "$AUTH_URL" ]; then
-      print_status "Authorization URL: $AUTH_URL"
-    fi
-    print_warning "Alternatively, you can rerun this script with --default-permissions option"
-    exit 1
-  else
-    print_error "Failed to create codespace"
-    print_error "$CODESPACE_OUTPUT"
-    exit 1
-  fi
-fi
+show_completion_help() {
+  cat <<EOF
+Usage: $PROG completion <bash|zsh|fish|powershell>
 
-# Extract the codespace name (last line of output)
-CODESPACE_NAME=$(echo "$CODESPACE_OUTPUT" | tail -n 1 | tr -d '\r\n')
+Print a completion script for your shell. Besides commands and options, it completes the
+values of -R (repositories you can access), -m (machine types available for the repository
+given with -R, or the one of the current directory), --devcontainer-path (the repository's
+devcontainer configurations) and -b, --stack-on and --base (the repository's remote branches,
+most recently committed to first), looked up with gh while you type. Branches are cached for
+5 minutes in ~/.local/state/create-codespace-and-checkout/cache.
 
-print_status "Codespace created successfully: $CODESPACE_NAME"
+Options:
+  -h, --help                   Show this help message and exit
 
-# Step 2: Wait for the codespace to be fully ready
-print_status "Waiting for codespace to be fully ready..."
+Examples:
+  source <($PROG completion bash)           # ~/.bashrc
+  source <($PROG completion zsh)            # ~/.zshrc
+  $PROG completion fish | source            # ~/.config/fish/config.fish
+  $PROG completion powershell | Out-String | Invoke-Expression  # \$PROFILE
+EOF
+  exit 0
+}
 
-if ! retry_until 30 10 "Checking codespace readiness" \
-  gh cs ssh -c "$CODESPACE_NAME" -- "bash -l -c 'test -d /workspaces/$REPO_NAME && cd /workspaces/$REPO_NAME && pwd'"; then
-  print_error "Codespace failed to become ready after 30 attempts"
-  exit 1
-fi
+show_doctor_help() {
+  cat <<EOF
+Usage: $PROG doctor
 
-print_status "Codespace is ready!"
+Check the local environment and print a table with the result of each check and, for
+problems, how to fix them. The exit code is non-zero when a check failed.
 
-# Step 3: Fetch latest remote information (silently with progress indicator)
-mise x ubi:charmbracelet/gum -- gum spin --spinner dot --title "Fetching latest remote information..." -- gh cs ssh -c "$CODESPACE_NAME" -- "bash -l -c 'cd /workspaces/$REPO_NAME && git fetch origin'"
-FETCH_EXIT_CODE=$?
+Checks:
+  bash                         Bash 4 or newer runs the script
+  gh                           gh is on the PATH and version $MIN_GH_VERSION or newer
+  auth                         gh is logged in to the host and the token has the codespace scope
+  mise + gum                   mise is on the PATH and can run gum
+  infocmp                      infocmp is available for the terminfo upload (optional)
+  network                      the GitHub API of the host can be reached
+  config                       every line of the config file is 'key = value' or a # comment
 
-if [ $FETCH_EXIT_CODE -ne 0 ]; then
-  print_error "Failed to fetch from remote. Git authentication may not be ready yet."
-  print_warning "Try connecting to the codespace manually: gh cs ssh -c $CODESPACE_NAME"
-  exit 1
-fi
+Options:
+  -h, --help                   Show this help message and exit
 
-print_status "Uploading xterm-ghostty terminfo to codespace..."
-if infocmp -x xterm-ghostty | gh cs ssh -c "$CODESPACE_NAME" -- tic -x - >/dev/null 2>&1; then
-  print_status "Successfully uploaded xterm-ghostty terminfo."
-else
-  print_warning "Failed to upload xterm-ghostty terminfo. Terminal features may be limited."
-fi
+Examples:
+  $PROG doctor
+EOF
+  exit 0
+}
 
-# Step 4: Checkout the branch (optional - skip if no branch name provided)
-if [ -n "$BRANCH_NAME" ]; then
-  print_status "Checking if branch '$BRANCH_NAME' exists remotely..."
-  REMOTE_CHECK=$(gh cs ssh -c "$CODESPACE_NAME" -- "bash -l -c 'cd /workspaces/$REPO_NAME && git ls-remote --heads origin $BRANCH_NAME'" 2>/dev/null || echo "")
+show_upgrade_help() {
+  cat <<EOF
+Usage: $PROG upgrade [--check] [--force]
 
-  if [ -n "$REMOTE_CHECK" ]; then
-    print_status "Branch '$BRANCH_NAME' exists remotely, checking out..."
-    if gh cs ssh -c "$CODESPACE_NAME" -- "bash -l -c 'cd /workspaces/$REPO_NAME && git checkout \"$BRANCH_NAME\"'" >/dev/null 2>&1; then
-      print_status "Successfully checked out branch '$BRANCH_NAME' in codespace '$CODESPACE_NAME'"
-    else
-      print_error "Failed to checkout branch '$BRANCH_NAME'"
-      print_warning "Codespace '$CODESPACE_NAME' was created but branch checkout failed"
-      exit 1
-    fi
-  else
-    print_warning "Branch '$BRANCH_NAME' doesn't exist remotely. Creating new branch..."
-    if gh cs ssh -c "$CODESPACE_NAME" -- "bash -l -c 'cd /workspaces/$REPO_NAME && git checkout -b \"$BRANCH_NAME\"'" >/dev/null 2>&1; then
-      print_status "Successfully created and checked out branch '$BRANCH_NAME' in codespace '$CODESPACE_NAME'"
-    else
-      print_error "Failed to create branch '$BRANCH_NAME'"
-      print_warning "Codespace '$CODESPACE_NAME' was created but branch creation failed"
-      exit 1
-    fi
-  fi
-else
-  print_status "No branch name provided, skipping checkout step"
-  print_status "Codespace will use the default branch"
-fi
+Check the latest release of $DIST_NAME, download it with gh, verify its SHA-256 checksum
+against the one published with the release and replace this script with it.
 
-# Step 5: Wait for codespace configuration to complete
-print_status "Waiting for codespace configuration to complete..."
+Options:
+  --check                      Only report whether a newer release is available
+  --force                      Reinstall the latest release even when it is installed already, or
+                               replace a development version or an installation managed by mise
+  -h, --help                   Show this help message and exit
 
-# Helper function to check if configuration is complete
-_check_config_complete() {
-  local last_log
-  last_log=$(gh cs logs --codespace "$CODESPACE_NAME" 2>/dev/null | tail -n 1 || echo "")
-  [[ "$last_log" == *"Finished configuring codespace."* ]]
+Examples:
+  $PROG upgrade --check
+  $PROG upgrade
+EOF
+  exit 0
 }
 
-if retry_until 60 10 "Checking configuration status" _check_config_complete; then
-  print_status "Codespace configuration complete! ✓"
-else
-  print_warning "Codespace configuration did not complete after 60 attempts"
-  print_warning "The codespace may still be configuring in the background"
-fi
+show_stats_help() {
+  cat <<EOF
+Usage: $PROG stats
+
+Summarize the runs recorded by the opt-in telemetry on this machine: results, cancellation
+reasons, features used and phase durations. Nothing is sent anywhere.
+
+Options:
+  -h, --help                   Show this help message and exit
+EOF
+  exit 0
+}
+
+# Helper function to set gum log style defaults
+# Variables defaulted here are listed in GUM_DEFAULTED, so the theme can change them while the
+# ones set in the environment win
+GUM_DEFAULTED=" "
+_gum_set_default() {
+  # $1 = var name, $2 = default value
+  if [ -z "${!1+x}" ]; then
+    export "$1=$2"
+    GUM_DEFAULTED+="$1 "
+  fi
+}
+
+# Set default gum log styling (can be overridden via environment)
+_gum_set_default GUM_LOG_LEVEL_FOREGROUND 212
+_gum_set_default GUM_LOG_LEVEL_BOLD true
+_gum_set_default GUM_LOG_TIME_FOREGROUND 244
+_gum_set_default GUM_LOG_MESSAGE_FOREGROUND 254
+_gum_set_default GUM_LOG_KEY_FOREGROUND 240
+_gum_set_default GUM_LOG_VALUE_FOREGROUND 118
+_gum_set_default GUM_LOG_SEPARATOR_FOREGROUND 240
+
+# Marks for finished waits and estimates; theme.symbols = false and --plain clear the ✓/✗ marks
+SYMBOL_OK="✓"
+SYMBOL_FAIL="✗"
+SYMBOL_APPROX="≈"
+
+# Apply the output theme: the colors of the --theme or theme.preset preset (dark, the default,
+# or light for light terminal backgrounds), then the theme.<element> colors for the level,
+# time, message, key, value and separator of log lines (ANSI 256 color numbers or #rrggbb).
+# theme.symbols = false clears the ✓/✗ marks: waits print done/failed instead, other lines drop them.
+# Usage: _apply_theme
+_apply_theme() {
+  local preset=${THEME:-$(_config_get theme.preset dark)}
+  local -a colors
+  local element
+  local var
+  local i=0
+
+  case $preset in
+  dark) colors=(212 244 254 240 118 240) ;;
+  light) colors=(126 242 235 245 28 245) ;;
+  *)
+    print_warning "Unknown theme.preset '$preset' (expected dark or light), using dark"
+    colors=(212 244 254 240 118 240)
+    ;;
+  esac
+  for element in level time message key value separator; do
+    var="GUM_LOG_${element^^}_FOREGROUND"
+    if [[ "$GUM_DEFAULTED" == *" $var "* ]]; then
+      export "$var=$(_config_get "theme.$element" "${colors[$i]}")"
+    fi
+    i=$((i + 1))
+  done
+
+  if [ "$(_config_get theme.symbols true)" = false ] || [ "$PLAIN_OUTPUT" = true ]; then
+    SYMBOL_OK=""
+    SYMBOL_FAIL=""
+  fi
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    SYMBOL_APPROX="~"
+  fi
+}
+
+# Function to print status messages using gum log with structured formatting
+# Messages often include gh output, so they are redacted before they are shown or logged
+print_status() {
+  local message
+  message=$(_redact <<<"$1")
+  _transcript "INFO" "$message"
+  _emit_event info message="$message"
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    _print_plain INFO "$message"
+    return
+  fi
+  mise x ubi:charmbracelet/gum -- gum log --structured --level info --time rfc822 "$message"
+}
+
+print_warning() {
+  local message
+  message=$(_redact <<<"$1")
+  _transcript "WARN" "$message"
+  _emit_event warning message="$message"
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    _print_plain WARN "$message"
+    return
+  fi
+  mise x ubi:charmbracelet/gum -- gum log --structured --level warn --time rfc822 "$message"
+}
+
+print_error() {
+  local message
+  message=$(_redact <<<"$1")
+  _transcript "ERROR" "$message"
+  _emit_event error message="$message"
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    _print_plain ERROR "$message"
+    return
+  fi
+  mise x ubi:charmbracelet/gum -- gum log --structured --level error --time rfc822 "$message"
+}
+
+# --plain output: every line of a message prefixed with a stable tag (INFO, WARN, ERROR, STEP)
+# and no colors, for screen readers and log collectors
+# Usage: _print_plain <tag> <message>
+_print_plain() {
+  local line
+
+  while IFS= read -r line; do
+    printf '%s %s\n' "$1" "$line"
+  done <<<"$2" >&2
+}
+
+# --output ndjson: write one JSON object per pipeline event (step_started, attempt, step_finished,
+# info, warning, error and a final result) to stdout as the run progresses. Every object has
+# the event name and a UTC timestamp; key=value adds a string field, key:=value a raw JSON value.
+# Usage: _emit_event <event> [key=value | key:=value]...
+_emit_event() {
+  local json
+  local field
+
+  if [ -z "$EVENT_FD" ]; then
+    return 0
+  fi
+  json="{\"event\":\"$1\",\"time\":\"$(date -u '+%Y-%m-%dT%H:%M:%SZ')\""
+  shift
+  for field in "$@"; do
+    if [[ "$field" == [a-z_]*:=* ]]; then
+      json+=",\"${field%%:=*}\":${field#*:=}"
+    else
+      json+=",\"${field%%=*}\":$(_json_string "${field#*=}")"
+    fi
+  done
+  echo "$json}" >&"$EVENT_FD"
+}
+
+# Start the --log-file debug log: a trace of every command the script runs (bash xtrace), with
+# its arguments and the output it captured, and every message, redacted like the console
+# output. The log is appended to, so a --detach run continues the log of the run that started
+# it; it is written through a filter process and may be completed a moment after the run ends.
+# Usage: _start_log_file
+# Returns 1 when the log file can't be written
+_start_log_file() {
+  local log_fd
+
+  if ! mkdir -p "$(dirname "$LOG_FILE")" 2>/dev/null || ! : >>"$LOG_FILE" 2>/dev/null; then
+    print_warning "Cannot write the log file $LOG_FILE, continuing without it"
+    LOG_FILE=""
+    return 1
+  fi
+  exec {log_fd}> >(_redact >>"$LOG_FILE")
+  printf '# %s %s, run started %s\n# %s %s\n' "$DIST_NAME" "$SCRIPT_VERSION" "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    "$PROG" "${ORIGINAL_ARGS[*]}" >&"$log_fd"
+  PS4='+ ${FUNCNAME[0]:-main}:${LINENO}: '
+  BASH_XTRACEFD=$log_fd
+  set -x
+}
+
+# Append a line to the bug report transcript (no-op unless --bug-report is active)
+# Usage: _transcript <label> <text>
+_transcript() {
+  if [ -n "${BUG_REPORT_TRANSCRIPT:-}" ]; then
+    printf '%s [%s] %s\n' "$(date '+%H:%M:%S')" "$1" "$2" >>"$BUG_REPORT_TRANSCRIPT"
+  fi
+}
+
+# Mask secrets before text is shown or written to a log: GitHub tokens, credentials in URLs,
+# OAuth codes and tokens in query strings, Authorization headers and the values of the
+# --secret secrets of this run (those of at least 4 characters, so short values don't mask
+# unrelated text)
+# Usage: some_command | _redact
+_redact() {
+  local secret
+  local value
+  local trace=false
+  local -a expressions=(
+    -e 's/(gh[pousr]_|github_pat_)[A-Za-z0-9_]+/\1***/g'
+    -e 's#(https?://)[^/@[:space:]]+@#\1***@#g'
+    -e 's/([?&](code|token|access_token|state)=)[^&[:space:]]+/\1***/g'
+    -e 's/([Aa]uthorization: *(token|[Bb]earer|[Bb]asic) )[^[:space:]]+/\1***/g'
+  )
+
+  # The escaped secrets must not show up in the --log-file trace, where the filter wouldn't match them
+  if [[ $- == *x* ]]; then
+    trace=true
+    set +x
+  fi
+  for secret in "${SECRETS[@]}"; do
+    value=${secret#*=}
+    if [ ${#value} -ge 4 ] && [[ "$value" != *$'\n'* ]]; then
+      expressions+=(-e "s#$(sed -E 's/[][\\.*^$+?(){}|#/]/\\&/g' <<<"$value")#***#g")
+    fi
+  done
+  sed -E "${expressions[@]}"
+  if [ "$trace" = true ]; then
+    set -x
+  fi
+}
+
+# Mask secrets (see _redact) and the home directory before text leaves the machine
+# Usage: some_command | _sanitize
+_sanitize() {
+  _redact | sed "s#${HOME:-/nonexistent}#~#g"
+}
+
+# Record why a run ended early (see CANCEL_REASON) in the state file, the --json summary and a
+# "cancelled" notification. Without an explicit reason, exit code 130 means a cancelled prompt,
+# failures before the workflow started are invalid input and anything later is a failed step.
+# Usage: _report_cancellation <exit_code>
+_report_cancellation() {
+  local exit_code=$1
+  local status
+
+  if [ -z "$CANCEL_REASON" ]; then
+    if [ "$exit_code" -eq 130 ]; then
+      CANCEL_REASON=user_abort
+    elif [ -z "$CURRENT_STEP" ]; then
+      CANCEL_REASON=invalid_input
+    else
+      CANCEL_REASON=failed
+    fi
+  fi
+
+  if [ -n "${CODESPACE_NAME:-}" ] && [ -f "$STATE_DIR/codespaces/$CODESPACE_NAME" ]; then
+    status=$(sed -n 's/^status=//p' "$STATE_DIR/codespaces/$CODESPACE_NAME")
+    _state_save "${status:-failed}"
+  fi
+  if [ "$JSON_OUTPUT" = true ]; then
+    _print_json_summary cancelled
+  fi
+  if [ "$DRY_RUN" = false ]; then
+    _notify cancelled "${CODESPACE_NAME:-}" "$REPO" "Run cancelled ($CANCEL_REASON) during the '${CURRENT_STEP:-setup}' step" "$CANCEL_REASON"
+  fi
+}
+
+# EXIT trap of the create flow: report early endings, record telemetry and write the --bug-report
+# Usage: _on_exit <exit_code>
+_on_exit() {
+  local exit_code=$1
+
+  if { [ "$exit_code" -ne 0 ] && [ "$exit_code" -ne "$EXIT_CONFIG_TIMEOUT" ]; } || [ -n "$CANCEL_REASON" ]; then
+    _report_cancellation "$exit_code"
+  fi
+  _record_final_step "$exit_code"
+  _emit_event result codespace="${CODESPACE_NAME:-}" repo="$REPO" branch="$BRANCH_NAME" \
+    outcome="$(_run_outcome "$exit_code")" cancel_reason="$CANCEL_REASON" exit_code:="$exit_code"
+  _telemetry_record
+  _history_record "$exit_code"
+  if [ -n "$TIMINGS_OUT" ]; then
+    _write_timings "$exit_code"
+  fi
+  if [ "$BUG_REPORT" = true ]; then
+    _write_bug_report "$exit_code"
+  fi
+}
+
+# Assemble the bug report from versions, resolved config, codespace state and transcript
+# Usage: _write_bug_report <exit_code>
+_write_bug_report() {
+  local exit_code=$1
+  local report_file
+  report_file="codespace-bug-report-$(date '+%Y%m%d-%H%M%S').md"
+
+  {
+    echo "# $DIST_NAME bug report"
+    echo ""
+    echo "- Date: $(date -u '+%Y-%m-%dT%H:%M:%SZ')"
+    echo "- Exit code: $exit_code"
+    echo ""
+    echo "## Versions"
+    echo ""
+    echo '```'
+    echo "$DIST_NAME: $SCRIPT_VERSION (commit $(_script_commit), built ${SCRIPT_BUILD_DATE:-unknown})"
+    echo "bash: $BASH_VERSION"
+    echo "os: $(uname -srm 2>/dev/null)"
+    "$GH" --version 2>&1 | head -n 1
+    echo "mise: $(mise --version 2>&1 | head -n 1)"
+    echo "gum: $(mise x ubi:charmbracelet/gum -- gum --version 2>&1 | head -n 1)"
+    echo '```'
+    echo ""
+    echo "## Resolved configuration"
+    echo ""
+    echo '```'
+    echo "REPO=$REPO"
+    echo "CODESPACE_SIZE=$CODESPACE_SIZE"
+    echo "DEVCONTAINER_PATH=$DEVCONTAINER_PATH"
+    echo "DISPLAY_NAME=$DISPLAY_NAME"
+    echo "BRANCH_NAME=$BRANCH_NAME"
+    echo "DEFAULT_PERMISSIONS=${DEFAULT_PERMISSIONS:-<unset>}"
+    echo "IMMEDIATE_MODE=$IMMEDIATE_MODE"
+    echo "TERM=${TERM:-<unset>}"
+    echo '```'
+    echo ""
+    echo "## Codespace"
+    echo ""
+    if [ -n "${CODESPACE_NAME:-}" ]; then
+      echo '```json'
+      _with_timeout "$GH" api "/user/codespaces/$CODESPACE_NAME" 2>&1
+      echo ""
+      echo '```'
+    else
+      echo "No codespace was created."
+    fi
+    echo ""
+    echo "## Transcript"
+    echo ""
+    echo '```'
+    cat "$BUG_REPORT_TRANSCRIPT"
+    echo '```'
+  } | _sanitize >"$report_file"
+
+  rm -f "$BUG_REPORT_TRANSCRIPT"
+  echo "Bug report written to $report_file (review before sharing)"
+}
+
+# Require Bash 4.0+ for associative arrays (check early, before gum usage)
+if [ -z "${BASH_VERSINFO[0]:-}" ] || [ "${BASH_VERSINFO[0]}" -lt 4 ]; then
+  current_bash=$(command -v bash)
+  echo "[ERROR] Bash 4.0+ is required (detected ${BASH_VERSINFO[0]:-unknown}.${BASH_VERSINFO[1]:-unknown} at ${current_bash:-unknown})." >&2
+  echo "[ERROR] Install a newer bash and ensure it is first in PATH." >&2
+  exit 1
+fi
+
+# Read a value from the config file (lines of "key = value", # starts a comment)
+# Usage: _config_get <key> [default]
+# Keys in the distribution policy file are enforced and win over the user's config file.
+# The last occurrence of a key wins; the default is printed when the key is missing
+_config_get() {
+  local key=$1
+  local default=${2:-}
+  local value=""
+  local file
+
+  for file in "$POLICY_FILE" "$CONFIG_FILE"; do
+    if [ -n "$file" ] && [ -f "$file" ]; then
+      value=$(sed -n -E "s/^[[:space:]]*${key//./\\.}[[:space:]]*=[[:space:]]*(.*[^[:space:]])[[:space:]]*$/\1/p" "$file" | tail -n 1)
+      if [ -n "$value" ]; then
+        break
+      fi
+    fi
+  done
+  echo "${value:-$default}"
+}
+
+# Download the distribution's enforced policy file (same format as the config file)
+# Falls back to the last downloaded copy when the URL can't be reached
+# Usage: _load_policy
+_load_policy() {
+  local policy_file="$STATE_DIR/policy"
+
+  if [ -z "$DIST_POLICY_URL" ]; then
+    return 0
+  fi
+
+  mkdir -p "$STATE_DIR" 2>/dev/null
+  if curl -fsSL "$DIST_POLICY_URL" -o "$policy_file.tmp" 2>/dev/null; then
+    mv "$policy_file.tmp" "$policy_file"
+  else
+    rm -f "$policy_file.tmp"
+    if [ -f "$policy_file" ]; then
+      print_warning "Could not download the policy from $DIST_POLICY_URL, using the cached copy"
+    else
+      print_warning "Could not download the policy from $DIST_POLICY_URL, continuing without it"
+      return 1
+    fi
+  fi
+  POLICY_FILE=$policy_file
+}
+
+# Persist the run state of the current codespace (one key=value file per codespace in STATE_DIR)
+# Usage: _state_save <status>
+_state_save() {
+  local status=$1
+  local state_dir="$STATE_DIR/codespaces"
+
+  if [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+  mkdir -p "$state_dir" 2>/dev/null || return 1
+  {
+    echo "codespace=$CODESPACE_NAME"
+    echo "repo=$REPO"
+    echo "branch=$BRANCH_NAME"
+    echo "stack_on=$STACK_ON"
+    echo "machine=$CODESPACE_SIZE"
+    echo "devcontainer_path=$DEVCONTAINER_PATH"
+    echo "step=$CURRENT_STEP"
+    echo "status=$status"
+    echo "cancel_reason=$CANCEL_REASON"
+    echo "updated=$(date -u '+%Y-%m-%dT%H:%M:%SZ')"
+  } >"$state_dir/$CODESPACE_NAME"
+}
+
+# Add the current step to STEP_TIMINGS for --timings-out: its duration, attempts and outcome
+# (ok, skipped, timeout, failed or cancelled)
+# Usage: _record_step_timing <outcome>
+_record_step_timing() {
+  local seconds=$(($(date +%s) - PHASE_STARTED_AT))
+  local attempts=$((STEP_ATTEMPTS > 0 ? STEP_ATTEMPTS : 1))
+
+  STEP_TIMINGS+=("$CURRENT_STEP"$'\t'"$seconds"$'\t'"$attempts"$'\t'"$1")
+  _emit_event step_finished step="$CURRENT_STEP" seconds:="$seconds" attempts:="$attempts" outcome="$1"
+}
+
+# Record the step the run ended in: cancelled by the user, failed, or the one that finished the run
+# Usage: _record_final_step <exit_code>
+_record_final_step() {
+  local exit_code=$1
+
+  if [ -z "$CURRENT_STEP" ] || [ "$PHASE_STARTED_AT" -eq 0 ]; then
+    return 0
+  fi
+  if [ "$CANCEL_REASON" = user_abort ] || [ "$CANCEL_REASON" = interrupted ]; then
+    _record_step_timing cancelled
+  elif [ -n "$CANCEL_REASON" ] || { [ "$exit_code" -ne 0 ] && [ "$exit_code" -ne "$EXIT_CONFIG_TIMEOUT" ]; }; then
+    _record_step_timing failed
+  else
+    _record_step_timing "$STEP_OUTCOME"
+  fi
+}
+
+# Record the step the run is entering, persisting it once a codespace exists
+# Usage: _begin_step <step>
+_begin_step() {
+  local now
+
+  now=$(date +%s)
+  if [ -n "$CURRENT_STEP" ]; then
+    TELEMETRY_PHASES+=("$CURRENT_STEP=$((now - PHASE_STARTED_AT))")
+    _record_step_timing "$STEP_OUTCOME"
+  fi
+  STEP_ATTEMPTS=0
+  STEP_OUTCOME=ok
+  _emit_event step_started step="$1"
+
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    _print_plain STEP "$1"
+  fi
+
+  # --quiet-progress replaces the per-attempt lines with one line per phase transition
+  if [ "$QUIET_PROGRESS" = true ]; then
+    if [ -n "$CURRENT_STEP" ]; then
+      print_status "Phase '$1' started ('$CURRENT_STEP' took $((now - PHASE_STARTED_AT))s)"
+    else
+      print_status "Phase '$1' started"
+    fi
+    LAST_PROGRESS_AT=$now
+  fi
+  PHASE_STARTED_AT=$now
+
+  CURRENT_STEP=$1
+  if [ -n "${CODESPACE_NAME:-}" ]; then
+    _state_save "running"
+  fi
+}
+
+# Run gh; with --dry-run the invocation is printed instead and a canned answer is returned
+# so the rest of the workflow can be walked through without touching any codespace
+# Usage: _gh <args...>
+_gh() {
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print gh "$@"
+    case "$1 $2" in
+    "cs create") echo "$DRY_RUN_CODESPACE" ;;
+    "cs logs") echo "Finished configuring codespace." ;;
+    "api /user/codespaces/"*) [[ "$*" == *".state"* ]] && echo "Available" ;;
+    esac
+    return 0
+  fi
+  _with_timeout "$GH" "$@"
+}
+
+# Run a command for at most COMMAND_TIMEOUT seconds (--command-timeout, 0 for no limit), so a
+# hung gh call, e.g. an SSH prompt nobody answers or a stalled connection, fails instead of
+# blocking the run forever. Uses timeout(1), or gtimeout where coreutils are prefixed (macOS);
+# without either the command runs without a limit. --foreground keeps gh in the terminal's
+# process group, so Ctrl+C reaches it and its prompts can read the terminal.
+# Usage: _with_timeout <command> [args...]
+# Returns 124 when the command timed out
+_with_timeout() {
+  local timeout_bin
+  local status=0
+
+  timeout_bin=$(command -v timeout || command -v gtimeout) || timeout_bin=""
+  if [ "${COMMAND_TIMEOUT:-300}" -eq 0 ] || [ -z "$timeout_bin" ]; then
+    "$@"
+    return
+  fi
+  "$timeout_bin" --foreground -k 5 "${COMMAND_TIMEOUT:-300}" "$@" || status=$?
+  # fd 3 is the console (see main), so the error shows where the caller silences the command
+  if [ $status -eq 124 ] && { : >&3; } 2>/dev/null; then
+    print_error "Command '${1##*/} ${2:-} ${3:-}' timed out after ${COMMAND_TIMEOUT:-300}s" 2>&3
+  elif [ $status -eq 124 ]; then
+    print_error "Command '${1##*/} ${2:-} ${3:-}' timed out after ${COMMAND_TIMEOUT:-300}s"
+  fi
+  return $status
+}
+
+# Print a command the way it would be run (shell-quoted) for --dry-run
+# Written to fd 3, which main points at stderr, so it survives output capture and retry_until
+# Usage: _dry_run_print <command> [args...]
+_dry_run_print() {
+  local quoted
+  quoted=$(printf '%q ' "$@")
+  echo "[dry-run] ${quoted% }" >&3
+}
+
+# Run a command silently behind a gum spinner. The command may be a shell function (such as
+# _workspace_exec), so it runs in the background while the spinner waits for it; commands are
+# dry-run aware themselves, so with --dry-run they only print what they would run.
+# Usage: _spin <title> <command> [args...]
+_spin() {
+  local title=$1
+  shift
+  local pid
+
+  if [ "$DRY_RUN" = true ] || [ "$QUIET_PROGRESS" = true ]; then
+    "$@" >/dev/null 2>&1
+    return
+  fi
+  if [ "$PLAIN_OUTPUT" = true ]; then
+    print_status "$title"
+    "$@" >/dev/null 2>&1
+    return
+  fi
+  "$@" >/dev/null 2>&1 &
+  pid=$!
+  mise x ubi:charmbracelet/gum -- gum spin --spinner dot --title "$title" -- \
+    bash -c 'while kill -0 "$1" 2>/dev/null; do sleep 0.2; done' bash "$pid"
+  wait "$pid"
+}
+
+# Turn a git remote or repository URL into OWNER/REPO, or HOST/OWNER/REPO for hosts other than
+# github.com. Handles https://HOST/OWNER/REPO[.git], ssh://[user@]HOST[:port]/OWNER/REPO[.git]
+# and scp-like [user@]HOST:OWNER/REPO[.git] remotes.
+# Usage: _parse_repo_url <url>
+# Prints the repository; returns 1 when the argument is not a repository URL
+_parse_repo_url() {
+  local url=$1
+  local host
+  local owner
+  local name
+
+  url=${url%/}
+  url=${url%.git}
+  if [[ "$url" =~ ^(https?|ssh|git)://([^@/]+@)?([^/:]+)(:[0-9]+)?/([^/]+)/([^/]+)$ ]]; then
+    host=${BASH_REMATCH[3]}
+    owner=${BASH_REMATCH[5]}
+    name=${BASH_REMATCH[6]}
+  elif [[ "$url" =~ ^([^@/]+@)?([^/:]+):([^/]+)/([^/]+)$ ]]; then
+    host=${BASH_REMATCH[2]}
+    owner=${BASH_REMATCH[3]}
+    name=${BASH_REMATCH[4]}
+  else
+    return 1
+  fi
+
+  if [ "$host" = github.com ]; then
+    echo "$owner/$name"
+  else
+    echo "$host/$owner/$name"
+  fi
+}
+
+# Detect the repository of the git clone in the current directory from its origin remote
+# Usage: _detect_repo
+# Prints the repository (see _parse_repo_url); returns 1 outside a clone or without origin
+_detect_repo() {
+  local url
+
+  url=$(git remote get-url origin 2>/dev/null) || return 1
+  _parse_repo_url "$url"
+}
+
+# A repository given as HOST/OWNER/REPO (e.g. ghes.example.com/team/app) points gh at HOST
+# for this run, using the token gh stores for that host; REPO becomes OWNER/REPO. Repository
+# URLs pasted from the browser or a git remote are turned into that form first. The result is
+# validated before any gh call uses it.
+# Usage: _split_repo_host
+# Prints the reason and returns 1 when the repository or host is not valid
+_split_repo_host() {
+  local spec=$REPO
+  local parsed
+  local host=""
+
+  if [[ "$REPO" == *:* ]] && parsed=$(_parse_repo_url "$REPO"); then
+    REPO=$parsed
+  fi
+  if [[ "$REPO" == */*/* ]]; then
+    host=${REPO%%/*}
+    REPO="${REPO#*/}"
+  fi
+  _validate_repo "$spec" "$host" || return 1
+  if [ -n "$host" ]; then
+    export GH_HOST="$host"
+  fi
+}
+
+# Check that REPO is OWNER/REPO with names GitHub accepts (and the host, if any, a host name),
+# explaining how to fix common mistakes
+# Usage: _validate_repo <spec> [host]
+# <spec> is the value as the user gave it, for the error message
+# Prints the reason and returns 1 when REPO or the host is not valid
+_validate_repo() {
+  local spec=$1
+  local host=${2:-}
+
+  if [[ "$REPO" =~ ^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?/[A-Za-z0-9._-]+$ ]] &&
+    [ "${REPO#*/}" != . ] && [ "${REPO#*/}" != .. ] &&
+    { [ -z "$host" ] || [[ "$host" =~ ^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]+)?$ ]]; }; then
+    return 0
+  fi
+
+  CANCEL_REASON=invalid_input
+  if [ -z "$spec" ]; then
+    print_error "No repository given"
+  elif [[ "$spec" == */tree/* || "$spec" == */pull/* || "$spec" == */blob/* ]]; then
+    print_error "'$spec' points into a repository, not at one"
+    echo "Pass branch URLs as an argument instead of with -R, or use -R owner/repo" >&2
+    return 1
+  elif [[ "$spec" != */* ]]; then
+    print_error "Repository '$spec' is missing the owner"
+    echo "Use owner/repo, e.g. -R myorg/$spec" >&2
+    return 1
+  elif [ -n "$host" ] && ! [[ "$host" =~ ^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]+)?$ ]]; then
+    print_error "Invalid host '$host' in repository '$spec'"
+  else
+    print_error "Invalid repository '$spec'"
+  fi
+  echo "Use owner/repo, host/owner/repo or a repository URL (https://github.com/owner/repo)" >&2
+  return 1
+}
+
+# Take the repository and branch from a branch URL copied from the GitHub UI,
+# e.g. https://github.com/owner/repo/tree/feature/foo (sets REPO and BRANCH_NAME)
+# Usage: _parse_branch_url <url>
+# Returns 1 when the argument is not a branch URL
+_parse_branch_url() {
+  local url=$1
+  local branch
+
+  url=${url%%[?#]*}
+  url=${url%/}
+  if ! [[ "$url" =~ ^https?://([^/]+)/([^/]+)/([^/]+)/tree/(.+)$ ]]; then
+    return 1
+  fi
+  # URLs of other hosts (GitHub Enterprise Server) keep the host, see _split_repo_host
+  REPO="${BASH_REMATCH[2]}/${BASH_REMATCH[3]}"
+  if [ "${BASH_REMATCH[1]}" != github.com ]; then
+    REPO="${BASH_REMATCH[1]}/$REPO"
+  fi
+  # Branch names with special characters are percent-encoded in URLs
+  branch=${BASH_REMATCH[4]//\\/\\\\}
+  BRANCH_NAME=$(printf '%b' "${branch//%/\\x}")
+}
+
+# Take the repository and branch from an OWNER/REPO@BRANCH (or HOST/OWNER/REPO@BRANCH)
+# shorthand, as copied from pull request pages and chat messages (sets REPO and BRANCH_NAME)
+# Usage: _parse_repo_ref <ref>
+# Returns 1 when the argument is not in that form
+_parse_repo_ref() {
+  if ! [[ "$1" =~ ^(([^@:/]+/)?[^@:/]+/[^@:/]+)@(.+)$ ]]; then
+    return 1
+  fi
+  REPO=${BASH_REMATCH[1]}
+  BRANCH_NAME=${BASH_REMATCH[3]}
+}
+
+# Name the branch after the --issue: its number and title go through issue.branch_template from
+# the config file (default: {number}-{slug}), so issue 4321 "Fix the login page" becomes
+# 4321-fix-the-login-page. Sets BRANCH_NAME, ISSUE_TITLE and ISSUE_URL.
+# Usage: _branch_from_issue
+# Returns 1 when the issue can't be fetched
+_branch_from_issue() {
+  local template
+  local output
+  local state
+  local slug
+
+  template=$(_config_get issue.branch_template "{number}-{slug}")
+  if ! output=$(_gh api "repos/$REPO/issues/$ISSUE_NUMBER" --jq '[.title, .html_url, .state] | @tsv' 2>&1); then
+    print_error "Could not fetch issue #$ISSUE_NUMBER of $REPO"
+    print_error "$output"
+    return 1
+  fi
+  IFS=$'\t' read -r ISSUE_TITLE ISSUE_URL state <<<"$output"
+  if [ "$DRY_RUN" = true ] && [ -z "$ISSUE_TITLE" ]; then
+    ISSUE_TITLE="issue"
+  fi
+  if [ "$state" = closed ]; then
+    print_warning "Issue #$ISSUE_NUMBER is closed"
+  fi
+
+  # Lowercase words joined by '-', short enough to stay readable in prompts and display names
+  slug=$(tr '[:upper:]' '[:lower:]' <<<"$ISSUE_TITLE" | sed -E 's/[^a-z0-9]+/-/g; s/^-+//' | cut -c1-50 | sed -E 's/-+$//')
+  BRANCH_NAME=${template//\{number\}/$ISSUE_NUMBER}
+  BRANCH_NAME=${BRANCH_NAME//\{slug\}/${slug:-issue}}
+  print_status "Using branch '$BRANCH_NAME' for issue #$ISSUE_NUMBER: $ISSUE_TITLE"
+}
+
+# With --pr, use the head branch of the pull request. For a contributor's pull request from a
+# fork, FORK_REPO is set to the fork so the branch is checked out from there.
+# Usage: _branch_from_pr
+# Sets BRANCH_NAME and FORK_REPO; returns 1 when the pull request or its fork can't be found
+_branch_from_pr() {
+  local output
+  local state
+  local head_repo
+
+  # The head repository goes last: it is empty for a deleted fork, and read would skip an empty field
+  if ! output=$(_gh api "repos/$REPO/pulls/$PR_NUMBER" --jq '[.head.ref, .state, .head.repo.full_name // ""] | @tsv' 2>&1); then
+    print_error "Could not fetch pull request #$PR_NUMBER of $REPO"
+    print_error "$output"
+    return 1
+  fi
+  IFS=$'\t' read -r BRANCH_NAME state head_repo <<<"$output"
+  if [ "$DRY_RUN" = true ] && [ -z "$BRANCH_NAME" ]; then
+    BRANCH_NAME="pr-$PR_NUMBER"
+    head_repo=$REPO
+  fi
+  if [ -z "$head_repo" ]; then
+    print_error "The fork of pull request #$PR_NUMBER was deleted, so its branch can't be checked out"
+    return 1
+  fi
+  if [ "$state" = closed ]; then
+    print_warning "Pull request #$PR_NUMBER is closed"
+  fi
+
+  if [ "${head_repo,,}" != "${REPO,,}" ]; then
+    FORK_REPO=$head_repo
+    print_status "Using branch '$BRANCH_NAME' of the fork $FORK_REPO for pull request #$PR_NUMBER"
+  else
+    print_status "Using branch '$BRANCH_NAME' for pull request #$PR_NUMBER"
+  fi
+}
+
+# Check whether a branch exists in REPO on GitHub; with --dry-run it is assumed not to exist,
+# like the checkout does
+# Usage: _branch_exists <branch>
+_branch_exists() {
+  [ "$DRY_RUN" != true ] && _gh api "repos/$REPO/git/ref/heads/$1" --silent >/dev/null 2>&1
+}
+
+# With --issue, create a new branch through the issue's development API (what gh issue develop
+# does), so it shows up as linked on the issue. It is created from --stack-on, --base or the
+# default branch before the codespace exists, so the clone already has it; a branch that
+# already exists is left alone, and a failure only warns (the codespace creates the branch).
+# Usage: _link_issue_branch
+_link_issue_branch() {
+  local base=${STACK_ON:-$BASE_REF}
+  local output
+
+  if _branch_exists "$BRANCH_NAME"; then
+    return 0
+  fi
+  print_status "Creating branch '$BRANCH_NAME' linked to issue #$ISSUE_NUMBER..."
+  if ! output=$(_gh issue develop "$ISSUE_NUMBER" -R "$REPO" --name "$BRANCH_NAME" ${base:+--base "$base"} 2>&1); then
+    print_warning "Could not link branch '$BRANCH_NAME' to issue #$ISSUE_NUMBER; it is created in the codespace instead"
+    print_warning "$output"
+    return 0
+  fi
+  print_status "Branch '$BRANCH_NAME' is linked to issue #$ISSUE_NUMBER"
+  BRANCH_PUSHED=true
+}
+
+# Expand a short branch name (no '/') with --branch-template or branch.template from the config
+# file, e.g. {user}/{date}-{name} turns fix-login into octocat/2024-06-01-fix-login. Placeholders:
+# {user} (GitHub login), {date} (YYYY-MM-DD), {name} (the short name). Existing branches are
+# checked out as given, so only new names follow the team's naming policy.
+# Usage: _apply_branch_template
+_apply_branch_template() {
+  local template=${BRANCH_TEMPLATE:-$(_config_get branch.template)}
+  local user
+  local branch
+
+  if [ -z "$template" ] || [ -z "$BRANCH_NAME" ] || [[ "$BRANCH_NAME" == */* ]] || _branch_exists "$BRANCH_NAME"; then
+    return 0
+  fi
+
+  branch=${template//\{name\}/$BRANCH_NAME}
+  branch=${branch//\{date\}/$(date '+%Y-%m-%d')}
+  if [[ "$branch" == *"{user}"* ]]; then
+    user=$(_gh api user --jq .login 2>/dev/null) || user=""
+    branch=${branch//\{user\}/${user:-${USER:-user}}}
+  fi
+  print_status "Using branch '$branch' for '$BRANCH_NAME' (branch template $template)"
+  BRANCH_NAME=$branch
+}
+
+# Check a branch name against the git ref-name rules (see git check-ref-format) before it
+# is used in any remote command
+# Usage: _validate_branch_name <branch>
+# Prints the reason and returns 1 when the name is not a valid branch name
+_validate_branch_name() {
+  local branch=$1
+  local reason=""
+
+  if [ -z "$branch" ]; then
+    reason="it is empty"
+  elif [[ "$branch" =~ [[:cntrl:][:space:]] ]]; then
+    reason="it contains whitespace or control characters"
+  elif [[ "$branch" == *[\~^:?*\[\\]* ]]; then
+    reason="it contains one of ~ ^ : ? * [ \\"
+  elif [[ "$branch" == -* ]]; then
+    reason="it starts with '-'"
+  elif [[ "$branch" == *..* || "$branch" == *@\{* || "$branch" == "@" ]]; then
+    reason="it contains '..' or '@{', or is '@'"
+  elif [[ "$branch" == /* || "$branch" == */ || "$branch" == *//* ]]; then
+    reason="it starts or ends with '/' or contains '//'"
+  elif [[ "$branch" == .* || "$branch" == */.* || "$branch" == *. || "$branch" == *.lock || "$branch" == *.lock/* ]]; then
+    reason="a path component starts with '.', ends with '.lock', or the name ends with '.'"
+  fi
+
+  if [ -n "$reason" ]; then
+    print_error "Invalid branch name '$branch': $reason"
+    return 1
+  fi
+}
+
+# Warn before provisioning on a branch whose last commit is older than stale_branch.days
+# (default 90) in the config file; interactively the run only continues after confirmation
+# Usage: _check_stale_branch
+_check_stale_branch() {
+  local threshold
+  local last_commit
+  local age_days
+  local author
+  local age
+
+  threshold=$(_config_get stale_branch.days 90)
+  if ! [[ "$threshold" =~ ^[0-9]+$ ]] || [ "$threshold" -eq 0 ]; then
+    return 0
+  fi
+
+  # Branches that don't exist yet have no commits to check
+  last_commit=$(_gh api "repos/$REPO/commits/$BRANCH_NAME" --jq '
+    [((now - (.commit.committer.date | fromdateiso8601)) / 86400 | floor), (.author.login // .commit.author.name)] | @tsv' 2>/dev/null)
+  if [ -z "$last_commit" ]; then
+    return 0
+  fi
+  IFS=$'\t' read -r age_days author <<<"$last_commit"
+  if [ "$age_days" -lt "$threshold" ]; then
+    return 0
+  fi
+
+  if [ "$age_days" -ge 730 ]; then
+    age="$((age_days / 365)) years"
+  elif [ "$age_days" -ge 60 ]; then
+    age="$((age_days / 30)) months"
+  else
+    age="$age_days days"
+  fi
+  print_warning "Branch '$BRANCH_NAME' was last touched $age ago by $author"
+
+  if [ "$IMMEDIATE_MODE" = false ] &&
+    ! mise x ubi:charmbracelet/gum -- gum confirm --default=false "Create a codespace for this stale branch anyway?"; then
+    print_status "Aborted"
+    CANCEL_REASON=user_abort
+    exit 130
+  fi
+}
+
+# Check whether a branch that doesn't exist yet in REPO is already the head of an open PR
+# (typically from a fork), which would be confusing once the new branch is pushed.
+# Interactively offers an alternative name (updating BRANCH_NAME); otherwise only warns.
+# Usage: _check_branch_collision
+_check_branch_collision() {
+  local prs
+  local alternative
+  local suffix=2
+  local choice
+  local line
+
+  # Existing branches are checked out as-is, so only new branch names can collide
+  if _gh api "repos/$REPO/git/ref/heads/$BRANCH_NAME" --silent >/dev/null 2>&1; then
+    return 0
+  fi
+
+  prs=$(_gh pr list -R "$REPO" --head "$BRANCH_NAME" --state open --json number,author,url \
+    --jq '.[] | "#\(.number) by \(.author.login): \(.url)"' 2>/dev/null)
+  if [ -z "$prs" ]; then
+    return 0
+  fi
+
+  print_warning "Branch '$BRANCH_NAME' doesn't exist in $REPO, but open pull requests already use it as head branch:"
+  while IFS= read -r line; do
+    print_warning "  $line"
+  done <<<"$prs"
+
+  # Suggest the first numbered variant that is neither a branch nor an open PR head
+  alternative="$BRANCH_NAME-$suffix"
+  while _gh api "repos/$REPO/git/ref/heads/$alternative" --silent >/dev/null 2>&1 ||
+    [ -n "$(_gh pr list -R "$REPO" --head "$alternative" --state open --json number --jq '.[].number' 2>/dev/null)" ]; do
+    suffix=$((suffix + 1))
+    alternative="$BRANCH_NAME-$suffix"
+  done
+
+  if [ "$IMMEDIATE_MODE" = true ]; then
+    print_warning "Continuing with '$BRANCH_NAME'; consider a different name such as '$alternative'"
+    return 0
+  fi
+
+  choice=$(printf '%s\n' "Use '$alternative'" "Keep '$BRANCH_NAME'" "Abort" |
+    mise x ubi:charmbracelet/gum -- gum choose --header "Branch name collides with an open pull request:") || exit 130
+  case $choice in
+  "Use '$alternative'")
+    BRANCH_NAME=$alternative
+    print_status "Using branch name '$BRANCH_NAME'"
+    ;;
+  "Abort")
+    CANCEL_REASON=user_abort
+    exit 130
+    ;;
+  esac
+}
+
+# Exit code for a failed workflow step (see the EXIT_* globals)
+# Usage: _step_exit_code <step>
+_step_exit_code() {
+  case $1 in
+  pre-create | secrets | create) echo "$EXIT_CREATE_FAILED" ;;
+  wait-ready) echo "$EXIT_NOT_READY" ;;
+  fetch) echo "$EXIT_FETCH_FAILED" ;;
+  checkout) echo "$EXIT_CHECKOUT_FAILED" ;;
+  wait-configured) echo "$EXIT_CONFIG_FAILED" ;;
+  *) echo 1 ;;
+  esac
+}
+
+# Handle a failed workflow step and exit: the failure is recorded in the state file or,
+# with --cleanup-on-failure, the partially set up codespace is deleted
+# Usage: _fail_step
+_fail_step() {
+  CANCEL_REASON=${CANCEL_REASON:-failed}
+  if [ -n "${CODESPACE_NAME:-}" ]; then
+    if [ "$CLEANUP_ON_FAILURE" = true ]; then
+      print_warning "Deleting codespace '$CODESPACE_NAME' because the '$CURRENT_STEP' step failed..."
+      if _gh cs delete -c "$CODESPACE_NAME" --force >/dev/null 2>&1; then
+        rm -f "$STATE_DIR/codespaces/$CODESPACE_NAME"
+        print_status "Deleted codespace '$CODESPACE_NAME'; nothing is left running"
+      else
+        print_error "Failed to delete codespace '$CODESPACE_NAME', delete it with: gh cs delete -c $CODESPACE_NAME"
+      fi
+    else
+      _state_save "failed"
+      print_status "Resume from the '$CURRENT_STEP' step with: $PROG resume $CODESPACE_NAME"
+    fi
+  fi
+  exit "$(_step_exit_code "$CURRENT_STEP")"
+}
+
+# Whether a step completed in the run being resumed (see cmd_resume) and is skipped: the
+# steps before RESUME_FROM, except the readiness wait, which finds the workspace folder
+# Usage: _resume_skips <step>
+_resume_skips() {
+  local step=$1
+
+  if [ -z "$RESUME_FROM" ] || [ "$step" = wait-ready ]; then
+    return 1
+  fi
+  [[ "${TELEMETRY_PHASE_NAMES%% "$RESUME_FROM" *} " == *" $step "* ]]
+}
+
+# Run a workflow step; when it fails in interactive mode, offer to retry it, skip it (when
+# <skippable> is true), view the codespace logs, delete the codespace or save state and exit.
+# Without a terminal, in immediate mode or with --cleanup-on-failure, failures go to _fail_step.
+# Usage: _run_step <step> <skippable> <command> [args...]
+# Returns 1 when the user chose to skip the failed step
+_run_step() {
+  local step=$1
+  local skippable=$2
+  shift 2
+  local choices
+  local choice
+
+  if _resume_skips "$step"; then
+    print_status "Skipping the '$step' step, it completed in an earlier run"
+    STEP_TIMINGS+=("$step"$'\t0\t0\tskipped')
+    _emit_event step_finished step="$step" seconds:=0 attempts:=0 outcome=skipped
+    return 0
+  fi
+  _begin_step "$step"
+  STEP_ATTEMPTS=1
+  while ! "$@"; do
+    if [ "$IMMEDIATE_MODE" = true ] || [ "$CLEANUP_ON_FAILURE" = true ] || [ ! -t 0 ]; then
+      _fail_step
+    fi
+
+    choices=("Retry")
+    if [ "$skippable" = true ]; then
+      choices+=("Skip")
+    fi
+    choices+=("View logs" "Delete codespace and exit" "Save state and exit")
+
+    while true; do
+      choice=$(printf '%s\n' "${choices[@]}" | mise x ubi:charmbracelet/gum -- gum choose --header "The '$step' step failed. What now?") || choice="Save state and exit"
+      if [ "$choice" != "View logs" ]; then
+        break
+      fi
+      _gh cs logs --codespace "$CODESPACE_NAME" 2>&1 | mise x ubi:charmbracelet/gum -- gum pager
+    done
+
+    case $choice in
+    "Retry")
+      CANCEL_REASON=""
+      STEP_ATTEMPTS=$((STEP_ATTEMPTS + 1))
+      _emit_event attempt step="$step" attempt:="$STEP_ATTEMPTS"
+      print_status "Retrying the '$step' step..."
+      ;;
+    "Skip")
+      CANCEL_REASON=""
+      STEP_OUTCOME=skipped
+      print_warning "Skipping the '$step' step"
+      return 1
+      ;;
+    "Delete codespace and exit")
+      CANCEL_REASON=user_abort
+      CLEANUP_ON_FAILURE=true
+      _fail_step
+      ;;
+    *)
+      CANCEL_REASON=user_abort
+      _fail_step
+      ;;
+    esac
+  done
+}
+
+# codespace_wait_configured only warns on a timeout (the run ends with EXIT_CONFIG_TIMEOUT);
+# a failed codespace fails the step
+# Usage: _wait_configured_step
+_wait_configured_step() {
+  local status=0
+
+  codespace_wait_configured || status=$?
+  if [ $status -eq 1 ]; then
+    CONFIG_TIMED_OUT=true
+    STEP_OUTCOME=timeout
+  fi
+  [ $status -ne 2 ]
+}
+
+# Fetch available machine types for a repository
+# Usage: _fetch_machine_types <repo>
+# Returns machine types as tab-separated "name\tdisplay_name" pairs, or empty on failure
+_fetch_machine_types() {
+  local repo=$1
+  _gh api "/repos/$repo/codespaces/machines" --jq '.machines[] | "\(.name)\t\(.display_name)"' 2>/dev/null
+}
+
+declare -A DISPLAY_BY_NAME
+declare -A NAME_BY_DISPLAY
+declare -a DISPLAY_NAMES
+
+# Parse machine types into lookup maps and ordered display list
+# Usage: _parse_machine_types <machine_types>
+_parse_machine_types() {
+  local machine_types=$1
+  local name
+  local display_name
+
+  DISPLAY_BY_NAME=()
+  NAME_BY_DISPLAY=()
+  DISPLAY_NAMES=()
+
+  while IFS=$'\t' read -r name display_name; do
+    [ -z "$name" ] && continue
+    DISPLAY_BY_NAME["$name"]="$display_name"
+    NAME_BY_DISPLAY["$display_name"]="$name"
+    DISPLAY_NAMES+=("$display_name")
+  done <<<"$machine_types"
+}
+
+# Choose machine type display name with optional preselect
+# Usage: _gum_choose_machine_type <default_display_name>
+_gum_choose_machine_type() {
+  local default_display_name=$1
+  local choose_args=(--header "Select machine type:")
+
+  if [ -n "$default_display_name" ]; then
+    choose_args+=(--selected "$default_display_name")
+  fi
+
+  mise x ubi:charmbracelet/gum -- gum choose "${choose_args[@]}"
+}
+
+# Check that gh is logged in to the GitHub host and, for OAuth tokens (which list their
+# scopes in the X-OAuth-Scopes header), that the token has the codespace scope, so a missing
+# login or scope is reported with its fix instead of as a creation failure later on
+# Usage: _check_auth
+# Returns 1 when gh is not logged in or the token lacks the codespace scope
+_check_auth() {
+  local host=${GH_HOST:-github.com}
+  local scopes
+
+  if [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+  if ! scopes=$(_token_scopes "$host"); then
+    print_error "gh is not logged in to $host (or its token is no longer valid)"
+    print_warning "Log in with: gh auth login --hostname $host --scopes codespace"
+    return 1
+  fi
+  if [ "$scopes" != "-" ] && [[ ",${scopes// /}," != *,codespace,* ]]; then
+    print_error "The gh token for $host lacks the codespace scope (scopes: ${scopes:-none})"
+    print_warning "Add it with: gh auth refresh --hostname $host --scopes codespace"
+    return 1
+  fi
+}
+
+# Print the scopes of the gh token for a host, comma-separated, or "-" for tokens that don't
+# report scopes (fine-grained tokens, GitHub App and Codespaces tokens)
+# Usage: _token_scopes <host>
+# Returns 1 when gh is not logged in to the host or the token is rejected
+_token_scopes() {
+  local host=$1
+  local headers
+
+  headers=$(_with_timeout "$GH" api --hostname "$host" -i /user 2>/dev/null) || return 1
+  if grep -qi '^x-oauth-scopes:' <<<"$headers"; then
+    sed -n 's/^[Xx]-[Oo][Aa]uth-[Ss]copes: *//p' <<<"$headers" | tr -d '\r'
+  else
+    echo "-"
+  fi
+}
+
+# Check that REPO exists and can be read with the current login before anything is created
+# Usage: _check_repo_access
+# Returns 1 when the repository is not accessible
+_check_repo_access() {
+  local output
+
+  if [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+  if ! output=$(_with_timeout "$GH" api "repos/$REPO" --jq .full_name 2>&1); then
+    print_error "Repository $REPO on ${GH_HOST:-github.com} is not accessible:"
+    print_error "$output"
+    if [[ "$output" == *"SAML"* || "$output" == *"SSO"* ]]; then
+      print_warning "Authorize your token for the organization's single sign-on with: gh auth refresh --hostname ${GH_HOST:-github.com} --scopes codespace"
+    else
+      print_warning "Check the owner/repo spelling, and that your account ($(_with_timeout "$GH" api user --jq .login 2>/dev/null || echo unknown)) has access to it"
+    fi
+    return 1
+  fi
+}
+
+# Check that CODESPACE_SIZE is available for REPO before creating the codespace, so an
+# unknown machine type fails fast instead of inside gh cs create. Interactively, one of the
+# available machine types can be picked instead.
+# Usage: _validate_machine_type
+# Returns 1 when the machine type isn't available in immediate mode
+_validate_machine_type() {
+  local machine_types
+  local selected_display_name
+
+  # Reuse the machine types fetched for the interactive picker
+  if [ ${#DISPLAY_NAMES[@]} -eq 0 ]; then
+    machine_types=$(_fetch_machine_types "$REPO")
+    if [ -z "$machine_types" ]; then
+      print_warning "Could not fetch machine types for $REPO, skipping machine type validation"
+      return 0
+    fi
+    _parse_machine_types "$machine_types"
+  fi
+
+  if [ -n "${DISPLAY_BY_NAME[$CODESPACE_SIZE]+set}" ]; then
+    return 0
+  fi
+
+  print_error "Machine type '$CODESPACE_SIZE' is not available for $REPO"
+  print_warning "Only the machine types allowed by the Codespaces policies of ${REPO%%/*} are listed"
+  if [ "$IMMEDIATE_MODE" = true ]; then
+    print_error "Available machine types: ${!DISPLAY_BY_NAME[*]}"
+    return 1
+  fi
+
+  selected_display_name=$(printf '%s\n' "${DISPLAY_NAMES[@]}" | _gum_choose_machine_type "") || exit 130
+  CODESPACE_SIZE=${NAME_BY_DISPLAY[$selected_display_name]}
+}
+
+declare -a DEVCONTAINER_PATHS
+
+# Discover the devcontainer configurations of a repository into DEVCONTAINER_PATHS
+# The Codespaces API lists the configurations on the repository's default branch
+# Usage: _fetch_devcontainers <repo>
+# Returns 1 when no configurations were found or the API call failed
+_fetch_devcontainers() {
+  local repo=$1
+  local paths
+
+  if [ ${#DEVCONTAINER_PATHS[@]} -eq 0 ]; then
+    paths=$(_gh api --paginate "/repos/$repo/codespaces/devcontainers" --jq '.devcontainers[].path' 2>/dev/null)
+    if [ -n "$paths" ]; then
+      mapfile -t DEVCONTAINER_PATHS <<<"$paths"
+    fi
+  fi
+  [ ${#DEVCONTAINER_PATHS[@]} -gt 0 ]
+}
+
+# Print the root of the local git clone the current directory is in, when its origin is REPO
+# Usage: _local_clone_root
+# Returns 1 when the current directory is not inside a local clone of REPO
+_local_clone_root() {
+  local root
+  local origin
+
+  command -v git >/dev/null 2>&1 || return 1
+  root=$(git rev-parse --show-toplevel 2>/dev/null) || return 1
+  origin=$(git -C "$root" remote get-url origin 2>/dev/null) || return 1
+  origin=${origin%.git}
+  [[ "${origin,,}" == *[/:]"${REPO,,}" ]] || return 1
+  echo "$root"
+}
+
+# Find the devcontainer configuration nearest to the current directory when it is inside a
+# local clone of REPO, so running from a monorepo subdirectory provisions that part of the repo
+# Sets LOCAL_DEVCONTAINER_PATH and LOCAL_SPARSE_PATH (the directory holding the configuration),
+# both relative to the repository root
+# Usage: _detect_local_devcontainer
+# Returns 1 when not inside a clone of REPO or no configuration was found up to the root
+_detect_local_devcontainer() {
+  local root
+  local dir
+  local relative
+  local candidate
+
+  LOCAL_DEVCONTAINER_PATH=""
+  LOCAL_SPARSE_PATH=""
+  root=$(_local_clone_root) || return 1
+
+  dir=$(pwd -P)
+  while true; do
+    relative=${dir#"$root"}
+    relative=${relative#/}
+    for candidate in .devcontainer/devcontainer.json .devcontainer.json; do
+      if [ -f "$dir/$candidate" ]; then
+        LOCAL_DEVCONTAINER_PATH=${relative:+$relative/}$candidate
+        LOCAL_SPARSE_PATH=$relative
+        return 0
+      fi
+    done
+    if [ "$dir" = "$root" ] || [ "$dir" = "/" ]; then
+      return 1
+    fi
+    dir=$(dirname "$dir")
+  done
+}
+
+# Choose one of the discovered devcontainer configurations, preselecting DEVCONTAINER_PATH
+# Usage: _gum_choose_devcontainer
+_gum_choose_devcontainer() {
+  printf '%s\n' "${DEVCONTAINER_PATHS[@]}" |
+    mise x ubi:charmbracelet/gum -- gum choose --header "Select devcontainer configuration:" --selected "$DEVCONTAINER_PATH"
+}
+
+# Check that DEVCONTAINER_PATH is one of the repository's devcontainer configurations before
+# creating the codespace. Interactively, one of the discovered configurations can be picked instead.
+# Usage: _validate_devcontainer_path
+# Returns 1 when the configuration doesn't exist in immediate mode
+_validate_devcontainer_path() {
+  local path
+
+  if ! _fetch_devcontainers "$REPO"; then
+    print_warning "Could not discover devcontainer configurations for $REPO, skipping devcontainer path validation"
+    return 0
+  fi
+
+  for path in "${DEVCONTAINER_PATHS[@]}"; do
+    if [ "$path" = "$DEVCONTAINER_PATH" ]; then
+      return 0
+    fi
+  done
+
+  print_error "Devcontainer configuration '$DEVCONTAINER_PATH' was not found in $REPO"
+  if [ "$IMMEDIATE_MODE" = true ]; then
+    print_error "Available devcontainer configurations: ${DEVCONTAINER_PATHS[*]}"
+    return 1
+  fi
+
+  DEVCONTAINER_PATH=$(_gum_choose_devcontainer) || exit 130
+}
+
+# Codespaces locations accepted by gh cs create --location
+CODESPACE_LOCATIONS=(EastUs SouthEastAsia WestEurope WestUs2)
+
+# Measure the TCP connect time to a codespaces location's regional Azure endpoint
+# The endpoint can be overridden with the location.probe_url.<location> config key
+# Usage: _probe_location_latency <location>
+# Prints the latency in milliseconds; returns 1 when the endpoint is unreachable
+_probe_location_latency() {
+  local location=$1
+  local url
+  local seconds
+
+  url=$(_config_get "location.probe_url.$location" "https://${location,,}.management.azure.com")
+  seconds=$(curl -s -o /dev/null --max-time 5 -w '%{time_connect}' "$url" 2>/dev/null) || return 1
+  awk -v s="$seconds" 'BEGIN { if (s <= 0) exit 1; printf "%d\n", s * 1000 }'
+}
+
+# Probe the latency to every codespaces location when --location is given: with
+# --location auto the fastest location is selected, otherwise a warning is printed
+# when the chosen location is clearly slower than the fastest one
+# Usage: _resolve_location
+_resolve_location() {
+  local location
+  local latency
+  local best=""
+  local best_latency=""
+  local chosen_latency=""
+
+  if [ -z "$CODESPACE_LOCATION" ]; then
+    return 0
+  fi
+
+  if [ "$DRY_RUN" = true ]; then
+    for location in "${CODESPACE_LOCATIONS[@]}"; do
+      _dry_run_print curl -s -o /dev/null --max-time 5 -w '%{time_connect}' \
+        "$(_config_get "location.probe_url.$location" "https://${location,,}.management.azure.com")"
+    done
+    if [ "$CODESPACE_LOCATION" = "auto" ]; then
+      CODESPACE_LOCATION=""
+    fi
+    return 0
+  fi
+
+  print_status "Probing latency to codespaces locations..."
+  for location in "${CODESPACE_LOCATIONS[@]}"; do
+    if ! latency=$(_probe_location_latency "$location"); then
+      print_warning "  $location: unreachable"
+      continue
+    fi
+    print_status "  $location: ${latency}ms"
+    if [ -z "$best" ] || [ "$latency" -lt "$best_latency" ]; then
+      best=$location
+      best_latency=$latency
+    fi
+    if [ "${location,,}" = "${CODESPACE_LOCATION,,}" ]; then
+      chosen_latency=$latency
+    fi
+  done
+
+  if [ "$CODESPACE_LOCATION" = "auto" ]; then
+    if [ -z "$best" ]; then
+      print_warning "Could not measure any location, letting GitHub choose the location"
+      CODESPACE_LOCATION=""
+    else
+      CODESPACE_LOCATION=$best
+      print_status "Selected location $best (${best_latency}ms)"
+    fi
+  elif [ -n "$chosen_latency" ] && [ $((chosen_latency - best_latency)) -gt 50 ] && [ "$chosen_latency" -gt $((best_latency * 2)) ]; then
+    print_warning "Location $CODESPACE_LOCATION (${chosen_latency}ms) is clearly slower than $best (${best_latency}ms)"
+    print_warning "Consider --location $best or --location auto"
+  fi
+}
+
+# Fetch the repositories the user can access, most recently pushed first
+# Usage: _fetch_repositories
+_fetch_repositories() {
+  _gh api "user/repos?per_page=100&sort=pushed" --jq '.[].full_name' 2>/dev/null
+}
+
+# Fetch the 100 most recently committed-to remote branches of a repository
+# Usage: _fetch_branches <repo>
+_fetch_branches() {
+  local repo=$1
+
+  _gh api graphql \
+    -f query='query($owner: String!, $name: String!) { repository(owner: $owner, name: $name) { refs(refPrefix: "refs/heads/", first: 100, orderBy: {field: TAG_COMMIT_DATE, direction: DESC}) { nodes { name } } } }' \
+    -F owner="${repo%%/*}" -F name="${repo#*/}" \
+    --jq '.data.repository.refs.nodes[].name' 2>/dev/null
+}
+
+# Fuzzy-pick a line from stdin; text that matches nothing is returned as typed
+# Usage: _gum_filter <header> <placeholder>
+_gum_filter() {
+  local header=$1
+  local placeholder=$2
+
+  mise x ubi:charmbracelet/gum -- gum filter --no-strict --header "$header" --placeholder "$placeholder"
+}
+
+# Print a liveness line under --quiet-progress when nothing was printed for the heartbeat interval
+# Usage: _heartbeat <description>
+_heartbeat() {
+  local description=$1
+  local now
+
+  now=$(date +%s)
+  if [ "$PHASE_STARTED_AT" -eq 0 ]; then
+    PHASE_STARTED_AT=$now
+  fi
+  if [ $((now - LAST_PROGRESS_AT)) -ge $((HEARTBEAT_MINUTES * 60)) ]; then
+    print_status "Still working: $description ($(((now - PHASE_STARTED_AT) / 60))m elapsed)"
+    LAST_PROGRESS_AT=$now
+  fi
+}
+
+# Redraw the single progress line of a wait: a spinner frame, the description, the attempt
+# and the elapsed time
+# Usage: _progress_line <description> <attempt> <max_attempts> <started_at>
+_progress_line() {
+  local elapsed
+  local frames=(⠋ ⠙ ⠹ ⠸ ⠼ ⠴ ⠦ ⠧ ⠇ ⠏)
+
+  elapsed=$(($(date +%s) - $4))
+  printf '\r\033[K%s %s (attempt %d/%d, %ds)' "${frames[elapsed % 10]}" "$1" "$2" "$3" "$elapsed" >&2
+}
+
+# Generic retry function for waiting on conditions
+# On a terminal, each wait is a single spinner line with the attempt and elapsed time that is
+# replaced by one result line; otherwise every attempt is logged on its own line.
+# Usage: retry_until <max_attempts> <sleep_seconds> <description> <command>
+# A command exit status of 2 is a permanent failure: retrying stops and 2 is returned
+retry_until() {
+  local max_attempts=$1
+  local sleep_seconds=$2
+  local description=$3
+  shift 3
+  local command=("$@")
+  local status
+  local started
+  local live=false
+  local interval
+  local i
+
+  started=$(date +%s)
+  if [ -t 2 ] && [ "$QUIET_PROGRESS" != true ] && [ "$DRY_RUN" != true ] && [ "$PLAIN_OUTPUT" != true ]; then
+    live=true
+  fi
+
+  local attempt=1
+  while [ $attempt -le "$max_attempts" ]; do
+    _emit_event attempt step="$CURRENT_STEP" description="$description" attempt:="$attempt" max_attempts:="$max_attempts"
+    if [ "$QUIET_PROGRESS" = true ]; then
+      _heartbeat "$description"
+    elif [ "$live" = true ]; then
+      _progress_line "$description" "$attempt" "$max_attempts" "$started"
+    else
+      print_status "$description (attempt $attempt/$max_attempts)..."
+    fi
+
+    status=0
+    "${command[@]}" >/dev/null 2>&1 || status=$?
+    if [ $status -eq 0 ] || [ $status -eq 2 ] || [ $attempt -eq "$max_attempts" ]; then
+      break
+    fi
+
+    # A rate limited poll waits for the API to allow requests again, and polls slow down
+    if [ -n "$RATE_LIMIT_WAIT" ]; then
+      if [ "$live" = true ]; then
+        printf '\r\033[K' >&2
+      fi
+      _rate_limit_pause "$sleep_seconds"
+    fi
+    interval=$((sleep_seconds + RATE_LIMIT_BACKOFF))
+    if [ "$live" = true ]; then
+      for ((i = 0; i < interval; i++)); do
+        _progress_line "$description" "$attempt" "$max_attempts" "$started"
+        sleep 1
+      done
+    else
+      sleep "$interval"
+    fi
+    attempt=$((attempt + 1))
+  done
+
+  if [ "$live" = true ]; then
+    printf '\r\033[K' >&2
+    if [ $status -eq 0 ]; then
+      print_status "$description ${SYMBOL_OK:-done} ($(($(date +%s) - started))s, attempt $attempt/$max_attempts)"
+    else
+      print_status "$description ${SYMBOL_FAIL:-failed} ($(($(date +%s) - started))s, attempt $attempt/$max_attempts)"
+    fi
+  fi
+  if [ $status -eq 0 ] || [ $status -eq 2 ]; then
+    return $status
+  fi
+  return 1
+}
+
+# Retry a step that often fails transiently over SSH right after creation (git authentication
+# or the SSH server not being ready yet), waiting retry.<step>.backoff seconds (default: 5)
+# before the first retry and twice as long before each next one. The number of retries comes
+# from --step-retries, else retry.<step>.retries in the config file (default: 2).
+# Usage: _retry_step <step> <command> [args...]
+# Returns the status of the last attempt
+_retry_step() {
+  local step=$1
+  shift
+  local retries
+  local backoff
+  local attempt=1
+  local status
+
+  retries=${STEP_RETRIES:-$(_config_get "retry.$step.retries" 2)}
+  backoff=$(_config_get "retry.$step.backoff" 5)
+  while true; do
+    status=0
+    "$@" || status=$?
+    if [ $status -eq 0 ] || [ "$attempt" -gt "$retries" ] || [ "$DRY_RUN" = true ]; then
+      return $status
+    fi
+    print_warning "The $step attempt failed, retrying in ${backoff}s (retry $attempt/$retries)..."
+    sleep "$backoff"
+    attempt=$((attempt + 1))
+    STEP_ATTEMPTS=$((STEP_ATTEMPTS + 1))
+    _emit_event attempt step="$step" attempt:="$STEP_ATTEMPTS"
+    backoff=$((backoff * 2))
+  done
+}
+
+# Make a gh api request from a polling loop and set API_RESPONSE to its (--jq filtered) body.
+# A rate limit response (HTTP 429, or HTTP 403 with no requests remaining or about the
+# secondary rate limit) sets RATE_LIMIT_WAIT from its Retry-After header, else from
+# X-RateLimit-Reset, else to 60 seconds, and slows down later polls by RATE_LIMIT_BACKOFF
+# seconds; see _rate_limit_pause. Polls wait for a slot of the shared request budget (_throttle).
+# Usage: _gh_api_poll <gh api args...>
+# Returns 1 when the request failed
+_gh_api_poll() {
+  local output
+  local status=0
+  local code
+  local retry_after
+  local reset
+
+  if [ "$DRY_RUN" != true ]; then
+    _throttle
+  fi
+  output=$(_gh api "$@" -i 2>/dev/null) || status=$?
+  output=${output//$'\r'/}
+  API_RESPONSE=$output
+  if [[ "$output" != HTTP/* ]]; then
+    return $status
+  fi
+  API_RESPONSE=$(sed '1,/^$/d' <<<"$output")
+  code=$(head -n 1 <<<"$output" | cut -d' ' -f2)
+  if [ "$code" = 429 ] || { [ "$code" = 403 ] && { _response_header "$output" x-ratelimit-remaining | grep -qx 0 ||
+    grep -qi "rate limit" <<<"$API_RESPONSE"; }; }; then
+    retry_after=$(_response_header "$output" retry-after)
+    reset=$(_response_header "$output" x-ratelimit-reset)
+    if [[ "$retry_after" =~ ^[0-9]+$ ]]; then
+      RATE_LIMIT_WAIT=$retry_after
+    elif [[ "$reset" =~ ^[0-9]+$ ]] && [ "$reset" -gt "$(date +%s)" ]; then
+      RATE_LIMIT_WAIT=$((reset - $(date +%s)))
+    else
+      RATE_LIMIT_WAIT=60
+    fi
+    RATE_LIMIT_BACKOFF=$((RATE_LIMIT_BACKOFF > 0 ? RATE_LIMIT_BACKOFF * 2 : 10))
+    if [ "$RATE_LIMIT_BACKOFF" -gt 120 ]; then
+      RATE_LIMIT_BACKOFF=120
+    fi
+    return 1
+  fi
+  return $status
+}
+
+# Print the value of a header in gh api -i output (case-insensitive name)
+# Usage: _response_header <output> <name>
+_response_header() {
+  awk -v name="$2" 'NR > 1 && $0 == "" { exit } index(tolower($0), name ": ") == 1 { print substr($0, length(name) + 3); exit }' <<<"$1"
+}
+
+# Wait out a rate limit response seen by _gh_api_poll, with a visible warning
+# Usage: _rate_limit_pause <poll_interval>
+_rate_limit_pause() {
+  if [ -z "$RATE_LIMIT_WAIT" ]; then
+    return 0
+  fi
+  print_warning "GitHub API rate limit reached: waiting ${RATE_LIMIT_WAIT}s, then polling every $(($1 + RATE_LIMIT_BACKOFF))s"
+  sleep "$RATE_LIMIT_WAIT"
+  RATE_LIMIT_WAIT=""
+}
+
+# Query the codespace state (Available, Starting, Shutdown, Failed, ...) from the Codespaces REST API
+# Usage: _codespace_state <codespace_name>
+_codespace_state() {
+  _gh_api_poll "/user/codespaces/$1" --jq '.state' && echo "$API_RESPONSE"
+}
+
+# Check that the codespace reports the Available state, recording it in CODESPACE_STATE
+# Returns 2 when the codespace reached a state it will not recover from
+_check_codespace_available() {
+  CODESPACE_STATE=""
+  if _gh_api_poll "/user/codespaces/$CODESPACE_NAME" --jq '.state'; then
+    CODESPACE_STATE=$API_RESPONSE
+  fi
+  case $CODESPACE_STATE in
+  Available) return 0 ;;
+  Failed | Deleted | Archived | Moved) return 2 ;;
+  *) return 1 ;;
+  esac
+}
+
+# Create a codespace for every line of a batch file, one after another. Lines are
+# "<repo> [branch]"; a repo given as HOST/OWNER/REPO is created on that host, so one run can
+# cover github.com and GitHub Enterprise Server. Each host's gh login is checked once,
+# and items on hosts without a login are reported instead of run. All items share the config
+# file and the extra create options given to batch.
+# Usage: cmd_batch [--file <file>] [create options...]
+cmd_batch() {
+  local file=-
+  local default_host=${GH_HOST:-github.com}
+  local repo
+  local branch
+  local host
+  local output
+  local codespace
+  local result
+  local row
+  local parsed
+  local status
+  local failed=0
+  local -a options=()
+  local -a rows=()
+  local -A host_ok=()
+
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --file)
+      file="$2"
+      shift 2
+      ;;
+    *)
+      options+=("$1")
+      shift
+      ;;
+    esac
+  done
+
+  if [ "$file" = - ] && [ -t 0 ]; then
+    print_error "No batch file given"
+    echo "Use batch --file <file>, or pipe the lines to batch"
+    exit 1
+  fi
+  if [ "$file" != - ] && [ ! -r "$file" ]; then
+    print_error "Cannot read batch file '$file'"
+    exit 1
+  fi
+
+  while read -r repo branch; do
+    if [ -z "$repo" ] || [[ "$repo" == \#* ]]; then
+      continue
+    fi
+    host=$default_host
+    if [[ "$repo" == *:* ]] && parsed=$(_parse_repo_url "$repo"); then
+      repo=$parsed
+    fi
+    if [[ "$repo" == */*/* ]]; then
+      host=${repo%%/*}
+      repo=${repo#*/}
+    fi
+
+    if [ -z "${host_ok[$host]:-}" ]; then
+      if _with_timeout "$GH" auth status --hostname "$host" >/dev/null 2>&1; then
+        host_ok[$host]=true
+      else
+        host_ok[$host]=false
+        print_error "Not logged in to $host; log in with: gh auth login --hostname $host"
+      fi
+    fi
+    if [ "${host_ok[$host]}" = false ]; then
+      rows+=("$host"$'\t'"$repo"$'\t'"${branch:--}"$'\t'"-"$'\t'"skipped (not logged in)")
+      failed=$((failed + 1))
+      continue
+    fi
+
+    print_status "[$host] Creating a codespace for $repo${branch:+ with branch '$branch'}..."
+    status=0
+    output=$(GH_HOST="$host" "${BASH_SOURCE[0]}" -x --json -R "$repo" ${branch:+-b "$branch"} "${options[@]}" </dev/null) || status=$?
+    codespace=$(sed -n 's/.*"codespace":"\([^"]*\)".*/\1/p' <<<"$output" | tail -n 1)
+    if [ "$status" -eq 0 ]; then
+      result="ok"
+    elif [ "$status" -eq "$EXIT_CONFIG_TIMEOUT" ]; then
+      result="ok (configuration still running)"
+    else
+      result="failed ($(sed -n 's/.*"cancel_reason":"\([^"]*\)".*/\1/p' <<<"$output" | tail -n 1), exit $status)"
+      failed=$((failed + 1))
+    fi
+    rows+=("$host"$'\t'"$repo"$'\t'"${branch:--}"$'\t'"${codespace:--}"$'\t'"$result")
+  done < <(cat -- "$file")
+
+  if [ ${#rows[@]} -eq 0 ]; then
+    print_warning "The batch file contains no repositories"
+    return 0
+  fi
+
+  echo ""
+  printf '%-24s %-32s %-24s %-40s %s\n' "HOST" "REPOSITORY" "BRANCH" "CODESPACE" "RESULT"
+  for row in "${rows[@]}"; do
+    IFS=$'\t' read -r host repo branch codespace result <<<"$row"
+    printf '%-24s %-32s %-24s %-40s %s\n' "$host" "$repo" "$branch" "$codespace" "$result"
+  done
+
+  if [ "$failed" -ne 0 ]; then
+    print_error "$failed of ${#rows[@]} batch items failed"
+    return 1
+  fi
+  print_status "Created all ${#rows[@]} codespaces"
+}
+
+# Add the branches listed in a file, or on stdin for "-", to MULTI_BRANCHES: one branch per
+# line (blank lines and # comments are skipped), or the JSON of gh pr list --json headRefName
+# Usage: _read_branches_file <file>
+# Returns 1 when the file can't be read or lists no branches
+_read_branches_file() {
+  local file=$1
+  local content
+  local branch
+  local count=${#MULTI_BRANCHES[@]}
+
+  if [ "$file" = - ] && [ -t 0 ]; then
+    print_error "--branches-file -: pipe the branch names to stdin"
+    return 1
+  fi
+  if [ "$file" != - ] && [ ! -r "$file" ]; then
+    print_error "Cannot read branches file '$file'"
+    return 1
+  fi
+  content=$(cat -- "$file")
+
+  if [[ "$content" =~ ^[[:space:]]*\[ ]]; then
+    content=$(grep -oE '"headRefName": *"[^"]*"' <<<"$content" | sed -E 's/^"headRefName": *"//; s/"$//')
+  fi
+  while read -r branch; do
+    if [ -z "$branch" ] || [[ "$branch" == \#* ]]; then
+      continue
+    fi
+    MULTI_BRANCHES+=("$branch")
+  done <<<"$content"
+
+  if [ ${#MULTI_BRANCHES[@]} -eq "$count" ]; then
+    print_error "No branches found in ${file/#-/stdin}"
+    return 1
+  fi
+}
+
+# Create and set up a codespace per branch (--branches, --branches-file), running up to PARALLEL runs of this
+# script at a time. Their progress is interleaved on stderr, each line prefixed with the
+# branch; a per-branch summary follows (a JSON array on stdout with --json). With --timings-out,
+# the timings of all runs are written as a JSON array; with --log-file, each branch gets its own log.
+# Usage: _create_branches <branch>...
+_create_branches() {
+  local results_dir
+  local branch
+  local codespace
+  local result
+  local status
+  local running=0
+  local failed=0
+  local i
+  local skip=false
+  local arg
+  local -a args=()
+  local -a child_args=()
+
+  # The options of this run apply to every branch, except the ones that select the branches
+  # and those each run gets its own value of, in either the "--option value" or the
+  # "--option=value" form
+  for arg in "${ORIGINAL_ARGS[@]}"; do
+    if [ "$skip" = true ]; then
+      skip=false
+      continue
+    fi
+    case $arg in
+    --branches | --branches-file | --parallel | --timings-out | --log-file) skip=true ;;
+    --branches=* | --branches-file=* | --parallel=* | --timings-out=* | --log-file=*) ;;
+    *) args+=("$arg") ;;
+    esac
+  done
+
+  results_dir=$(mktemp -d "${TMPDIR:-/tmp}/codespace-branches.XXXXXX")
+  print_status "Creating $# codespaces, $PARALLEL at a time: $*"
+  for i in $(seq 1 $#); do
+    branch=${!i}
+    if [ "$running" -ge "$PARALLEL" ]; then
+      wait -n || true
+      running=$((running - 1))
+    fi
+    child_args=()
+    if [ -n "$TIMINGS_OUT" ]; then
+      child_args+=(--timings-out "$results_dir/$i.timings.json")
+    fi
+    # Each branch logs to its own file next to --log-file, e.g. run.log.feature-x
+    if [ -n "$LOG_FILE" ]; then
+      child_args+=(--log-file "$LOG_FILE.${branch//\//-}")
+    fi
+    (
+      "${BASH_SOURCE[0]}" "${args[@]}" "${child_args[@]}" -x --json -b "$branch" 2>&1 >"$results_dir/$i.json" </dev/null |
+        while IFS= read -r line; do
+          printf '[%s] %s\n' "$branch" "$line"
+        done >&2
+      echo "${PIPESTATUS[0]}" >"$results_dir/$i.status"
+    ) &
+    running=$((running + 1))
+  done
+  wait
+
+  echo "" >&2
+  if [ "$JSON_OUTPUT" = true ]; then
+    printf '['
+  else
+    printf '%-32s %-40s %s\n' "BRANCH" "CODESPACE" "RESULT"
+  fi
+  for i in $(seq 1 $#); do
+    branch=${!i}
+    status=$(cat "$results_dir/$i.status" 2>/dev/null || echo 1)
+    codespace=$(sed -n 's/.*"codespace":"\([^"]*\)".*/\1/p' "$results_dir/$i.json" | tail -n 1)
+    if [ "$status" -eq 0 ]; then
+      result="ok"
+    elif [ "$status" -eq "$EXIT_CONFIG_TIMEOUT" ]; then
+      result="ok (configuration still running)"
+    else
+      result="failed ($(sed -n 's/.*"cancel_reason":"\([^"]*\)".*/\1/p' "$results_dir/$i.json" | tail -n 1), exit $status)"
+      failed=$((failed + 1))
+    fi
+    if [ "$JSON_OUTPUT" = true ]; then
+      [ "$i" -gt 1 ] && printf ','
+      tail -n 1 "$results_dir/$i.json" | tr -d '\n'
+    else
+      printf '%-32s %-40s %s\n' "$branch" "${codespace:--}" "$result"
+    fi
+  done
+  if [ "$JSON_OUTPUT" = true ]; then
+    printf ']\n'
+  fi
+  if [ -n "$TIMINGS_OUT" ]; then
+    {
+      printf '['
+      for i in $(seq 1 $#); do
+        [ "$i" -gt 1 ] && printf ','
+        tr -d '\n' <"$results_dir/$i.timings.json" 2>/dev/null || printf 'null'
+      done
+      printf ']\n'
+    } >"$TIMINGS_OUT" || print_warning "Could not write the step timings to $TIMINGS_OUT"
+  fi
+  rm -rf "$results_dir"
+
+  if [ "$failed" -ne 0 ]; then
+    print_error "$failed of $# branches failed"
+    return 1
+  fi
+  print_status "Created codespaces for all $# branches"
+}
+
+# Run a command in every codespace of a repository concurrently
+# Usage: cmd_exec_all [-R <repo>] -- <command> [args...]
+cmd_exec_all() {
+  local repo=$REPO
+  local codespaces
+  local name
+  local status
+  local i
+  local failed=0
+  local -a command=()
+  local -a names=()
+  local -a pids=()
+  local -a statuses=()
+
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    -R)
+      repo="$2"
+      shift 2
+      ;;
+    --)
+      shift
+      command=("$@")
+      break
+      ;;
+    -*)
+      print_error "Unknown option: $1"
+      echo "Use exec-all --help to see available options"
+      exit 1
+      ;;
+    *)
+      print_error "Unexpected argument: $1"
+      echo "Separate the command to run with --, e.g. exec-all -R owner/repo -- git pull"
+      exit 1
+      ;;
+    esac
+  done
+
+  if [ ${#command[@]} -eq 0 ]; then
+    print_error "No command given"
+    echo "Separate the command to run with --, e.g. exec-all -R owner/repo -- git pull"
+    exit 1
+  fi
+  if [ -z "$repo" ]; then
+    repo=$(_detect_repo) || repo=$DIST_DEFAULT_REPO
+  fi
+  REPO=$repo
+  _split_repo_host || exit 1
+  repo=$REPO
+
+  if ! codespaces=$(_with_timeout "$GH" cs list -R "$repo" --json name --jq '.[].name' 2>&1); then
+    print_error "Failed to list codespaces for $repo"
+    print_error "$codespaces"
+    exit 1
+  fi
+
+  if [ -z "$codespaces" ]; then
+    print_warning "No codespaces found for $repo"
+    return 0
+  fi
+
+  REPO_NAME=$(echo "$repo" | cut -d'/' -f2)
+
+  while IFS= read -r name; do
+    [ -z "$name" ] && continue
+    print_status "Running in $name: ${command[*]}"
+    (
+      CODESPACE_NAME=$name
+      _find_workspace_dir || true
+      codespace_detect_layout >/dev/null 2>&1
+      COMMAND_TIMEOUT=0 _workspace_exec "${command[@]}" 2>&1 |
+        while IFS= read -r line; do
+          printf '[%s] %s\n' "$name" "$line"
+        done
+      exit "${PIPESTATUS[0]}"
+    ) &
+    names+=("$name")
+    pids+=("$!")
+  done <<<"$codespaces"
+
+  for i in "${!pids[@]}"; do
+    status=0
+    wait "${pids[$i]}" || status=$?
+    statuses+=("$status")
+    if [ "$status" -ne 0 ]; then
+      failed=$((failed + 1))
+    fi
+  done
+
+  echo ""
+  printf '%-48s %s\n' "CODESPACE" "RESULT"
+  for i in "${!names[@]}"; do
+    if [ "${statuses[$i]}" -eq 0 ]; then
+      printf '%-48s %s\n' "${names[$i]}" "ok"
+    else
+      printf '%-48s %s\n' "${names[$i]}" "failed (exit ${statuses[$i]})"
+    fi
+  done
+
+  if [ "$failed" -ne 0 ]; then
+    print_error "Command failed in $failed of ${#names[@]} codespaces"
+    return 1
+  fi
+  print_status "Command succeeded in all ${#names[@]} codespaces"
+}
+
+# Remote execution
+#
+# Values never become part of remote shell code: scripts are constant text sent on stdin to a
+# login shell in the codespace, and every value (directories, branch names, user commands)
+# arrives as a positional parameter. Like ssh, gh cs ssh joins its command line into one string
+# for the remote shell, so the parameters are quoted exactly once, by _remote_quote.
+# _remote_script runs in a login shell (PATH and tools from the profile); _remote_exec runs a
+# plain argv without one, and _workspace_exec runs an argv in the workspace from a login shell.
+
+# Quote arguments for the remote shell (nothing at all for no arguments)
+# Usage: _remote_quote [args...]
+_remote_quote() {
+  if [ $# -gt 0 ]; then
+    printf '%q ' "$@"
+  fi
+}
+
+# Run a constant script in CODESPACE_NAME with the arguments as $1, $2, ... The script runs with
+# stdin from /dev/null, so a command in it can't read the rest of the script.
+# Usage: _remote_script <script> [args...]
+_remote_script() {
+  local script=$1
+  shift
+
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print gh cs ssh -c "$CODESPACE_NAME" -- bash -l -s -- "$@"
+    sed 's/^/[dry-run]   | /' <<<"$script" >&3
+    return 0
+  fi
+  printf '{\n%s\n} </dev/null\n' "$script" |
+    _with_timeout "$GH" cs ssh -c "$CODESPACE_NAME" -- "bash -l -s -- $(_remote_quote "$@")"
+}
+
+# Run a single command (an argv, no shell code) in CODESPACE_NAME, passing the local stdin on.
+# With --tty a terminal is allocated for interactive commands, which run without a time limit.
+# Usage: _remote_exec [--tty] <command> [args...]
+_remote_exec() {
+  local command
+  local -a ssh_args=()
+  local COMMAND_TIMEOUT=$COMMAND_TIMEOUT
+
+  if [ "${1:-}" = --tty ]; then
+    ssh_args=(-t)
+    COMMAND_TIMEOUT=0
+    shift
+  fi
+
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print gh cs ssh -c "$CODESPACE_NAME" -- "${ssh_args[@]}" "$@"
+    return 0
+  fi
+  command=$(_remote_quote "$@")
+  _with_timeout "$GH" cs ssh -c "$CODESPACE_NAME" -- "${ssh_args[@]}" "${command% }"
+}
+
+# Run a command (an argv, no shell code) in the workspace directory of CODESPACE_NAME
+# Usage: _workspace_exec <command> [args...]
+_workspace_exec() {
+  _remote_script 'cd "$1" || exit 1
+shift
+"$@"' "${WORKSPACE_DIR:-/workspaces/$REPO_NAME}" "$@"
+}
+
+# Directory where user commands, post-checkout hooks and SSH sessions start: the workspace
+# directory, or its --workdir subdirectory
+# Usage: _command_dir
+_command_dir() {
+  echo "${WORKSPACE_DIR:-/workspaces/$REPO_NAME}${WORKDIR:+/$WORKDIR}"
+}
+
+# Check whether a gh cs create error is about the limit on the number of codespaces per account
+# Usage: _is_codespace_limit_error <output>
+_is_codespace_limit_error() {
+  grep -qiE "maximum number of codespaces|codespace limit|too many codespaces" <<<"$1"
+}
+
+# Make room for a new codespace at the account's limit by deleting one: with --delete-oldest
+# the least recently used one (skipping those gh refuses to delete because of unsaved
+# changes), otherwise one picked from the list, least recently used first
+# Usage: _free_codespace_slot
+# Returns 1 when nothing was deleted
+_free_codespace_slot() {
+  local codespaces
+  local choice
+  local name repo state last_used
+
+  if [ "$DELETE_OLDEST" = false ] && { [ "$IMMEDIATE_MODE" = true ] || [ ! -t 0 ]; }; then
+    return 1
+  fi
+  if ! codespaces=$(_gh cs list --json name,repository,state,lastUsedAt --jq '
+    sort_by(.lastUsedAt) | .[] | [.name, .repository, .state, (.lastUsedAt | sub("T.*"; ""))] | @tsv' 2>/dev/null) || [ -z "$codespaces" ]; then
+    print_warning "Could not list your codespaces to make room for a new one"
+    return 1
+  fi
+
+  if [ "$DELETE_OLDEST" = true ]; then
+    while IFS=$'\t' read -r name repo state last_used; do
+      [ -z "$name" ] && continue
+      print_warning "Codespace limit reached, deleting the least recently used codespace '$name' ($repo, last used $last_used)..."
+      if _gh cs delete -c "$name" >/dev/null 2>&1; then
+        rm -f "$STATE_DIR/codespaces/$name"
+        return 0
+      fi
+      print_warning "Failed to delete codespace '$name'; it may have unsaved changes"
+    done <<<"$codespaces"
+    return 1
+  fi
+
+  print_warning "You have reached the maximum number of codespaces for your account"
+  choice=$({
+    while IFS=$'\t' read -r name repo state last_used; do
+      printf '%s  (%s, %s, last used %s)\n' "$name" "$repo" "$state" "$last_used"
+    done <<<"$codespaces"
+    echo "Cancel"
+  } | mise x ubi:charmbracelet/gum -- gum choose --header "Delete a codespace to make room (least recently used first):") || return 1
+  if [ "$choice" = Cancel ]; then
+    return 1
+  fi
+  name=${choice%%  *}
+  print_status "Deleting codespace '$name'..."
+  if ! _gh cs delete -c "$name" --force >/dev/null 2>&1; then
+    print_error "Failed to delete codespace '$name'"
+    return 1
+  fi
+  rm -f "$STATE_DIR/codespaces/$name"
+}
+
+# Check whether an API or gh error is about billing (disabled billing, spending limit, budget)
+# Usage: _is_billing_error <output>
+_is_billing_error() {
+  grep -qiE "billing|spending limit|payment|budget" <<<"$1"
+}
+
+# Explain a billing error and point at the billing settings of the billable owner
+# Usage: _print_billing_error <output>
+_print_billing_error() {
+  CANCEL_REASON=quota
+  print_error "Codespaces can't be created for $REPO because of the billing state of ${BILLING_OWNER:-the account that pays for it}:"
+  print_error "$1"
+  print_warning "Check the payment method and the Codespaces spending limit or budget at: ${BILLING_URL:-https://${GH_HOST:-github.com}/settings/billing}"
+  if [ -z "$BILLING_URL" ]; then
+    print_warning "If an organization pays for these codespaces, ask one of its owners to check its billing settings"
+  fi
+}
+
+# Check whether an API or gh error is about a Codespaces policy of the owner (restricted
+# machine types, codespaces disabled for the user or the repository)
+# Usage: _is_policy_error <output>
+_is_policy_error() {
+  grep -qiE "polic(y|ies)|not allowed|not permitted|disabled for" <<<"$1"
+}
+
+# Explain a policy error and point at the owner whose policies apply
+# Usage: _print_policy_error <output>
+_print_policy_error() {
+  local owner=${BILLING_OWNER:-${REPO%%/*}}
+
+  CANCEL_REASON=policy
+  print_error "Codespaces can't be created for $REPO because of a Codespaces policy of $owner:"
+  print_error "$1"
+  print_warning "If the policy restricts machine types, pick one it allows with -m (requested: $CODESPACE_SIZE); otherwise ask an owner of $owner to review its Codespaces policies"
+}
+
+# Offer the machine types smaller than CODESPACE_SIZE after a policy rejected it and switch to
+# the one picked; the API lists machine types smallest first
+# Usage: _choose_smaller_machine_type
+# Returns 1 when not interactive, no smaller machine type is available or the user cancelled
+_choose_smaller_machine_type() {
+  local smaller=()
+  local display_name
+  local selected_display_name
+
+  if [ "$IMMEDIATE_MODE" = true ] || [ ! -t 0 ]; then
+    return 1
+  fi
+  if [ ${#DISPLAY_NAMES[@]} -eq 0 ]; then
+    _parse_machine_types "$(_fetch_machine_types "$REPO")"
+  fi
+  for display_name in "${DISPLAY_NAMES[@]}"; do
+    if [ "${NAME_BY_DISPLAY[$display_name]}" = "$CODESPACE_SIZE" ]; then
+      break
+    fi
+    smaller+=("$display_name")
+  done
+  if [ ${#smaller[@]} -eq 0 ]; then
+    return 1
+  fi
+
+  selected_display_name=$(printf '%s\n' "${smaller[@]}" |
+    mise x ubi:charmbracelet/gum -- gum choose --header "The $CODESPACE_SIZE machine type is not allowed by policy, select a smaller one:") || return 1
+  CODESPACE_SIZE=${NAME_BY_DISPLAY[$selected_display_name]}
+}
+
+# Add a NAME=VALUE secret (or NAME, taking the value from the environment) to SECRETS
+# Usage: _add_secret <spec> <source>
+# Returns 1 when the name is invalid or the value is missing; <source> is used in errors
+_add_secret() {
+  local spec=$1
+  local source=$2
+  local name=${spec%%=*}
+  local value
+
+  if ! [[ "$name" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]] || [[ "${name^^}" == GITHUB_* ]]; then
+    print_error "$source: invalid secret name '$name' (letters, digits and _, not starting with GITHUB_)"
+    return 1
+  fi
+  if [[ "$spec" == *=* ]]; then
+    value=${spec#*=}
+  elif [ -n "${!name+x}" ]; then
+    value=${!name}
+  else
+    print_error "$source: '$name' has no value (use NAME=VALUE or export $name)"
+    return 1
+  fi
+  SECRETS+=("$name=$value")
+}
+
+# Read secrets from a dotenv-style file: NAME=VALUE lines, with optional "export " prefixes and
+# surrounding quotes; blank lines and lines starting with # are ignored
+# Usage: _read_secrets_file <file>
+# Returns 1 when the file can't be read or contains an invalid line
+_read_secrets_file() {
+  local file=$1
+  local line
+  local value
+
+  if [ ! -r "$file" ]; then
+    print_error "--secrets-from-file: cannot read '$file'"
+    return 1
+  fi
+  while IFS= read -r line || [ -n "$line" ]; do
+    line=${line%$'\r'}
+    if [[ "$line" =~ ^[[:space:]]*(#|$) ]]; then
+      continue
+    fi
+    line=${line#export }
+    if [[ "$line" != *=* ]]; then
+      print_error "$file: expected NAME=VALUE, got '${line%%=*}'"
+      return 1
+    fi
+    value=${line#*=}
+    if [[ "$value" =~ ^\"(.*)\"$ ]] || [[ "$value" =~ ^\'(.*)\'$ ]]; then
+      value=${BASH_REMATCH[1]}
+    fi
+    _add_secret "${line%%=*}=$value" "$file" || return 1
+  done <"$file"
+}
+
+# Create or update the Codespaces user secrets in SECRETS and give REPO access to them, before
+# the codespace is created so the devcontainer build can use them. Values go to gh on stdin, so
+# they don't show up in process listings or --dry-run output. Access is added per repository,
+# keeping the other repositories an existing secret is shared with.
+# Usage: codespace_set_secrets
+# Returns 1 when a secret could not be set or shared with the repository
+codespace_set_secrets() {
+  local repo_id
+  local trace=false
+  local status=0
+
+  repo_id=$(_gh api "repos/$REPO" --jq '.id' 2>/dev/null)
+  if [ "$DRY_RUN" = true ]; then
+    repo_id="<repo-id>"
+  elif [ -z "$repo_id" ]; then
+    print_error "Could not look up the repository id of $REPO for its secrets"
+    return 1
+  fi
+  # The --log-file trace would record the values quoted in ways _redact doesn't match, and
+  # multi-line values aren't redacted at all
+  if [[ $- == *x* ]]; then
+    trace=true
+    { set +x; } 2>/dev/null
+  fi
+  _set_secrets "$repo_id" || status=$?
+  if [ "$trace" = true ]; then
+    set -x
+  fi
+  return $status
+}
+
+# Set each secret in SECRETS and give the repository with id <repo_id> access to it
+# Usage: _set_secrets <repo_id>
+# Returns 1 when a secret could not be set or shared
+_set_secrets() {
+  local repo_id=$1
+  local secret
+  local name
+
+  for secret in "${SECRETS[@]}"; do
+    name=${secret%%=*}
+    print_status "Setting Codespaces user secret $name for $REPO..."
+    if ! printf '%s' "${secret#*=}" | _gh secret set "$name" --user >/dev/null 2>&1; then
+      print_error "Failed to set the Codespaces user secret $name"
+      return 1
+    fi
+    if ! _gh api -X PUT "/user/codespaces/secrets/$name/repositories/$repo_id" >/dev/null 2>&1; then
+      print_error "Failed to give $REPO access to the Codespaces user secret $name"
+      return 1
+    fi
+  done
+}
+
+# Ask the API who would be billed for a codespace in REPO before creating one, so a billing
+# freeze, an exhausted spending limit or a policy that blocks codespaces is reported up front
+# with the settings to check instead of as a generic create failure. Sets BILLING_OWNER and
+# BILLING_URL.
+# Usage: _check_billing
+# Returns 1 when codespaces are blocked by billing or policy; other errors are left to gh cs create
+_check_billing() {
+  local output
+  local owner_type
+
+  if ! output=$(_gh api "/repos/$REPO/codespaces/new" --jq '[.billable_owner.login, .billable_owner.type] | @tsv' 2>&1); then
+    if _is_billing_error "$output"; then
+      _print_billing_error "$output"
+      return 1
+    elif _is_policy_error "$output"; then
+      _print_policy_error "$output"
+      return 1
+    fi
+    return 0
+  fi
+
+  IFS=$'\t' read -r BILLING_OWNER owner_type <<<"$output"
+  if [ "$owner_type" = "Organization" ]; then
+    BILLING_URL="https://${GH_HOST:-github.com}/organizations/$BILLING_OWNER/settings/billing"
+  elif [ -n "$BILLING_OWNER" ]; then
+    BILLING_URL="https://${GH_HOST:-github.com}/settings/billing"
+  fi
+}
+
+# Look up the prebuild availability of CODESPACE_SIZE in CODESPACE_LOCATION for the default
+# branch the codespace is created from; prints none, in_progress or ready
+# Usage: _prebuild_availability
+# Returns 1 when the API call failed or the machine type isn't listed
+_prebuild_availability() {
+  local query=""
+  local availability
+
+  if [ -n "$CODESPACE_LOCATION" ]; then
+    query="?location=$CODESPACE_LOCATION"
+  fi
+  availability=$(_gh api "/repos/$REPO/codespaces/machines$query" \
+    --jq ".machines[] | select(.name == \"$CODESPACE_SIZE\") | .prebuild_availability // \"none\"" 2>/dev/null)
+  [ -n "$availability" ] || return 1
+  echo "$availability"
+}
+
+# Helper for retry_until: succeeds once the prebuild is ready, stops when there is none
+_check_prebuild_ready() {
+  PREBUILD_STATE=$(_prebuild_availability) || return 1
+  case $PREBUILD_STATE in
+  ready) return 0 ;;
+  in_progress) return 1 ;;
+  *) return 2 ;;
+  esac
+}
+
+# Report whether the codespace will start from a prebuild or be built from scratch. With
+# --require-prebuild, a prebuild that is still being built is waited for (up to 30 minutes)
+# and a missing one aborts the run, so a large repository is never started cold by accident.
+# Prebuilds are configured per devcontainer configuration; the API only reports them per
+# machine type and location, so this assumes the prebuild covers DEVCONTAINER_PATH.
+# Usage: _check_prebuild
+# Returns 1 when a prebuild is required but not available
+_check_prebuild() {
+  local status
+
+  if [ "$DRY_RUN" = true ]; then
+    _prebuild_availability >/dev/null
+    return 0
+  fi
+  if ! PREBUILD_STATE=$(_prebuild_availability); then
+    print_warning "Could not look up prebuild availability for $CODESPACE_SIZE in $REPO"
+    if [ "$REQUIRE_PREBUILD" = true ]; then
+      CANCEL_REASON=policy
+      print_error "--require-prebuild: can't confirm that a prebuild is available, not creating the codespace"
+      return 1
+    fi
+    return 0
+  fi
+
+  if [ "$PREBUILD_STATE" = in_progress ] && [ "$REQUIRE_PREBUILD" = true ]; then
+    print_status "A prebuild for $CODESPACE_SIZE is being built, waiting for it to finish..."
+    status=0
+    retry_until 30 60 "Checking prebuild status" _check_prebuild_ready || status=$?
+    if [ $status -eq 1 ]; then
+      CANCEL_REASON=timeout
+      print_error "The prebuild for $CODESPACE_SIZE did not finish within 30 minutes"
+      return 1
+    fi
+  fi
+
+  case $PREBUILD_STATE in
+  ready)
+    print_status "A prebuild is available: the codespace will start from it"
+    ;;
+  in_progress)
+    print_warning "A prebuild for $CODESPACE_SIZE is still being built: the codespace will be built from scratch"
+    print_warning "Rerun with --require-prebuild to wait for the prebuild instead"
+    ;;
+  *)
+    print_warning "No prebuild is available for $CODESPACE_SIZE${CODESPACE_LOCATION:+ in $CODESPACE_LOCATION}: the codespace will be built from scratch, which can take a long time"
+    if [ "$REQUIRE_PREBUILD" = true ]; then
+      CANCEL_REASON=policy
+      print_error "--require-prebuild: not creating a codespace without a prebuild"
+      return 1
+    fi
+    ;;
+  esac
+}
+
+# Workflow steps
+#
+# Each step reads the shared configuration globals (REPO, REPO_NAME, CODESPACE_SIZE,
+# DEVCONTAINER_PATH, DISPLAY_NAME, DEFAULT_PERMISSIONS, CODESPACE_NAME), reports progress
+# through the print_* functions and returns a status code instead of exiting, so the
+# steps can be composed by main or by other scripts that source this file.
+
+# Step 1: Create the codespace and capture the output
+# Usage: codespace_create
+# Sets CODESPACE_NAME and CODESPACE_OUTPUT; returns 1 on failure
+codespace_create() {
+  local display_name_flag=()
+  local location_flag=()
+  local status_flag=()
+  local auth_url
+  local freed=0
+  local COMMAND_TIMEOUT=$COMMAND_TIMEOUT
+
+  # Build display name flag conditionally
+  if [ -n "$DISPLAY_NAME" ]; then
+    display_name_flag=("--display-name" "$DISPLAY_NAME")
+  fi
+  if [ -n "$CODESPACE_LOCATION" ]; then
+    location_flag=("--location" "$CODESPACE_LOCATION")
+  fi
+  # --create-status: gh cs create itself blocks until the codespace is available, which takes
+  # longer than creating it, so the command gets at least 30 minutes
+  if [ "$CREATE_STATUS" = true ]; then
+    status_flag=("--status")
+    if [ "${COMMAND_TIMEOUT:-300}" -ne 0 ] && [ "${COMMAND_TIMEOUT:-300}" -lt 1800 ]; then
+      COMMAND_TIMEOUT=1800
+    fi
+  fi
+
+  print_status "Creating new codespace with $CODESPACE_SIZE machine type..."
+  while ! CODESPACE_OUTPUT=$(_gh cs create -R "$REPO" -m "$CODESPACE_SIZE" --devcontainer-path "$DEVCONTAINER_PATH" "${display_name_flag[@]}" "${location_flag[@]}" $DEFAULT_PERMISSIONS "${status_flag[@]}" "${CREATE_ARGS[@]}" 2>&1); do
+    # At the account's codespace limit, creation is retried once a codespace was deleted to make
+    # room; the deletion can take a moment to count, so a few codespaces may be deleted at most
+    if _is_codespace_limit_error "$CODESPACE_OUTPUT" && [ "$freed" -lt 3 ] && _free_codespace_slot; then
+      freed=$((freed + 1))
+      print_status "Retrying codespace creation..."
+      continue
+    fi
+    # A machine type restricted by policy can be swapped for a smaller one interactively
+    if ! grep -q "You must authorize" <<<"$CODESPACE_OUTPUT" && _is_policy_error "$CODESPACE_OUTPUT" &&
+      ! _is_billing_error "$CODESPACE_OUTPUT" && _choose_smaller_machine_type; then
+      print_status "Retrying codespace creation with $CODESPACE_SIZE machine type..."
+      continue
+    fi
+
+    # Check if the failure is due to permissions authorization required
+    if echo "$CODESPACE_OUTPUT" | grep -q "You must authorize or deny additional permissions"; then
+      print_error "Codespace creation requires additional permissions authorization"
+      CANCEL_REASON=policy
+      print_error "Please authorize the permissions in your browser, then try again"
+      # Extract and display the authorization URL if present
+      auth_url=$(echo "$CODESPACE_OUTPUT" | grep -o "https://github\.com/[^[:space:]]*")
+      if [ -n "$auth_url" ]; then
+        print_status "Authorization URL: $auth_url"
+      fi
+      print_warning "Alternatively, you can rerun this script with --default-permissions option"
+    elif _is_codespace_limit_error "$CODESPACE_OUTPUT"; then
+      CANCEL_REASON=quota
+      print_error "You have reached the maximum number of codespaces for your account:"
+      print_error "$CODESPACE_OUTPUT"
+      if [ "$DELETE_OLDEST" = false ]; then
+        print_warning "Delete one with gh cs delete -c <name>, or rerun with --delete-oldest to delete the least recently used one"
+      fi
+    elif _is_billing_error "$CODESPACE_OUTPUT"; then
+      _print_billing_error "$CODESPACE_OUTPUT"
+    elif _is_policy_error "$CODESPACE_OUTPUT"; then
+      _print_policy_error "$CODESPACE_OUTPUT"
+    else
+      print_error "Failed to create codespace"
+      print_error "$CODESPACE_OUTPUT"
+    fi
+    return 1
+  done
+  _transcript "OUTPUT" "$(_redact <<<"gh cs create: $CODESPACE_OUTPUT")"
+
+  # Extract the codespace name (last line of output; with --status, the last line that is a name)
+  if [ "$CREATE_STATUS" = true ]; then
+    CODESPACE_NAME=$(tr -d '\r' <<<"$CODESPACE_OUTPUT" | grep -E '^[[:alnum:]-]+$' | tail -n 1)
+  else
+    CODESPACE_NAME=$(echo "$CODESPACE_OUTPUT" | tail -n 1 | tr -d '\r\n')
+  fi
+
+  print_status "Codespace created successfully: $CODESPACE_NAME"
+}
+
+# Step 2: Wait for the codespace to be fully ready
+# Usage: codespace_wait_ready
+# Sets CODESPACE_STATE; returns 1 when the codespace or its workspace never became available
+codespace_wait_ready() {
+  local status
+  local probe_attempts
+  local probe_interval
+
+  print_status "Waiting for codespace to be fully ready..."
+
+  # Poll the API for the Available state first, then probe the workspace over SSH once the codespace
+  # is up. With --create-status, gh cs create already waited, so one check normally confirms it.
+  status=0
+  if [ "$CREATE_STATUS" = true ] && _check_codespace_available; then
+    print_status "gh cs create --status already waited for the codespace to become available"
+  else
+    retry_until 30 10 "Checking codespace state" _check_codespace_available || status=$?
+  fi
+  if [ $status -eq 2 ]; then
+    print_error "Codespace entered the '$CODESPACE_STATE' state and will not become available"
+    return 1
+  elif [ $status -ne 0 ]; then
+    print_error "Codespace failed to become available after 30 attempts (last state: ${CODESPACE_STATE:-unknown})"
+    CANCEL_REASON=timeout
+    return 1
+  fi
+
+  if ! retry_until 10 5 "Looking for the workspace folder" _find_workspace_dir; then
+    print_error "No workspace folder for $REPO_NAME (/workspaces/$REPO_NAME or the devcontainer's workspaceFolder) became accessible after 10 attempts"
+    return 1
+  fi
+  if [ -n "$WORKSPACE_ROOT" ] && [ "$WORKSPACE_ROOT" != "/workspaces/$REPO_NAME" ]; then
+    print_status "Using the workspace folder $WORKSPACE_ROOT"
+  fi
+
+  # Teams can define what "ready" means for their devcontainer, e.g. a service that must be up
+  if [ -n "$READY_PROBE" ]; then
+    probe_attempts=$(_config_get ready.probe_attempts 30)
+    probe_interval=$(_config_get ready.probe_interval 10)
+    if ! retry_until "$probe_attempts" "$probe_interval" "Running readiness probe" _run_ready_probe; then
+      print_error "Readiness probe '$READY_PROBE' did not succeed after $probe_attempts attempts"
+      CANCEL_REASON=timeout
+      return 1
+    fi
+  fi
+
+  print_status "Codespace is ready!"
+}
+
+# Helper for retry_until: run the readiness probe command in the workspace folder
+# Usage: _run_ready_probe
+_run_ready_probe() {
+  _remote_script 'cd "$1" || exit 1
+eval "$2"' "${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}" "$READY_PROBE"
+}
+
+# Ask the codespace for its workspace folder instead of assuming /workspaces/<repo>: the
+# devcontainer's workspaceFolder (CODESPACE_VSCODE_FOLDER in the codespace), else
+# /workspaces/<repo>, else a /workspaces entry whose name only differs in case
+# Usage: _find_workspace_dir
+# Sets WORKSPACE_ROOT and WORKSPACE_DIR; returns 1 when no workspace folder exists (yet)
+_find_workspace_dir() {
+  local dir
+
+  dir=$(_remote_script 'if [ -n "${CODESPACE_VSCODE_FOLDER:-}" ] && [ -d "$CODESPACE_VSCODE_FOLDER" ]; then
+  echo "$CODESPACE_VSCODE_FOLDER"
+  exit 0
+fi
+if [ -d "/workspaces/$1" ]; then
+  echo "/workspaces/$1"
+  exit 0
+fi
+for dir in /workspaces/*/; do
+  name=${dir%/}
+  name=${name##*/}
+  if [ "${name,,}" = "${1,,}" ]; then
+    echo "${dir%/}"
+    exit 0
+  fi
+done
+exit 1' "$REPO_NAME" 2>/dev/null) || return 1
+  dir=$(tail -n 1 <<<"$dir" | tr -d '\r')
+
+  if [ -n "$dir" ]; then
+    WORKSPACE_ROOT=$dir
+    WORKSPACE_DIR=$dir
+  fi
+}
+
+# Detect the checkout layout of the workspace. Some devcontainers turn /workspaces/<repo> into a
+# bare repository with worktrees (directly or in a subdirectory); then the worktree of the default
+# branch (or the first worktree) becomes the workspace directory for all later git commands.
+# Usage: codespace_detect_layout
+# Sets WORKSPACE_DIR; returns 1 when the layout could not be inspected (the default is kept)
+codespace_detect_layout() {
+  local script
+  local worktree
+
+  # The awk program prints the default branch's worktree, or else the first non-bare one
+  script='cd "$1" || exit 1
+if [ "$(git rev-parse --is-inside-work-tree 2>/dev/null)" = true ]; then
+  pwd
+  exit 0
+fi
+if ! git rev-parse --git-dir >/dev/null 2>&1; then
+  for dir in */; do
+    if git -C "$dir" rev-parse --git-dir >/dev/null 2>&1; then
+      cd "$dir" && break
+    fi
+  done
+fi
+default=$(git symbolic-ref --quiet --short refs/remotes/origin/HEAD 2>/dev/null)
+git worktree list --porcelain | awk -v branch="refs/heads/${default#origin/}" "
+  /^worktree / { path = substr(\$0, 10) }
+  /^bare\$/ { path = \"\" }
+  /^branch / && path != \"\" {
+    if (first == \"\") first = path
+    if (\$2 == branch) { print path; found = 1; exit }
+  }
+  END { if (!found && first != \"\") print first }"'
+
+  if ! worktree=$(_remote_script "$script" "${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}" 2>/dev/null); then
+    print_warning "Could not inspect the checkout layout, using ${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}"
+    return 1
+  fi
+  worktree=$(tail -n 1 <<<"$worktree" | tr -d '\r')
+
+  if [ -z "$worktree" ] || [ "$worktree" = "${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}" ]; then
+    return 0
+  fi
+  WORKSPACE_DIR=$worktree
+  print_status "Detected a worktree layout, using the worktree at $WORKSPACE_DIR"
+}
+
+# Step 3: Fetch latest remote information (silently with progress indicator)
+# Usage: codespace_fetch
+# Returns 1 when the fetch failed
+codespace_fetch() {
+  if ! _spin "Fetching latest remote information..." _workspace_exec git fetch origin; then
+    print_error "Failed to fetch from remote. Git authentication may not be ready yet."
+    return 1
+  fi
+}
+
+# Upload the terminfo entry of the local terminal ($TERM, or TERMINFO_NAME from --terminfo) so
+# the terminal works properly over SSH. Standard entries already present in the image are
+# skipped unless they were asked for with --terminfo.
+# Usage: codespace_upload_terminfo
+# Returns 1 when the upload failed (the workflow treats this as a warning)
+codespace_upload_terminfo() {
+  local name=${TERMINFO_NAME:-${TERM:-}}
+  local entry
+
+  if [ -z "$name" ] || [ "$name" = dumb ]; then
+    print_status "No terminal type to upload, skipping terminfo upload"
+    return 0
+  fi
+  # infocmp is usually missing on Windows (Git Bash, MSYS2), where the terminal is not a terminfo client anyway
+  if ! command -v infocmp >/dev/null 2>&1; then
+    if [ -n "$TERMINFO_NAME" ] || [ "$TERMINFO_REQUIRED" = true ]; then
+      print_warning "infocmp is not installed, cannot upload the $name terminfo"
+      return 1
+    fi
+    print_status "infocmp is not installed, skipping terminfo upload"
+    return 0
+  fi
+  if [ -z "$TERMINFO_NAME" ]; then
+    case $name in
+    xterm | xterm-256color | screen | screen-256color | tmux | tmux-256color | linux | vt100)
+      print_status "Terminal type '$name' is available in the codespace, skipping terminfo upload"
+      return 0
+      ;;
+    esac
+  fi
+
+  if ! entry=$(infocmp -x "$name" 2>/dev/null); then
+    print_warning "No local terminfo entry for '$name'. Terminal features may be limited."
+    return 1
+  fi
+
+  print_status "Uploading $name terminfo to codespace..."
+  if _retry_step terminfo _install_terminfo "$entry"; then
+    print_status "Successfully uploaded $name terminfo."
+  else
+    print_warning "Failed to upload $name terminfo. Terminal features may be limited."
+    return 1
+  fi
+}
+
+# Compile a terminfo entry (infocmp -x output) in the codespace
+# Usage: _install_terminfo <entry>
+_install_terminfo() {
+  _remote_exec tic -x - <<<"$1" >/dev/null 2>&1
+}
+
+# Copy the local files listed in personalization.files (space-separated, e.g. ~/.tmux.conf)
+# into the home directory of the codespace
+# Usage: codespace_copy_dotfiles
+# Returns 1 when the copy failed
+codespace_copy_dotfiles() {
+  local file
+  local -a files=()
+
+  for file in $(_config_get personalization.files); do
+    file=${file/#\~/$HOME}
+    if [ -f "$file" ]; then
+      files+=("$file")
+    else
+      print_warning "Personalization file '$file' not found, skipping it"
+    fi
+  done
+  if [ ${#files[@]} -eq 0 ]; then
+    return 0
+  fi
+
+  print_status "Copying ${#files[@]} personalization file(s) to the codespace home directory..."
+  if _gh cs cp -c "$CODESPACE_NAME" -e -- "${files[@]}" "remote:~/" >/dev/null 2>&1; then
+    print_status "Successfully copied personalization files."
+  else
+    print_warning "Failed to copy personalization files to the codespace."
+    return 1
+  fi
+}
+
+# Copy a local file or directory into the codespace; relative remote paths are relative to the
+# home directory in the codespace, as with scp
+# Usage: codespace_copy <local_path> <remote_path>
+# Returns 1 when the copy failed
+codespace_copy() {
+  local local_path=$1
+  local remote_path=$2
+  local recursive=()
+
+  if [ -d "$local_path" ]; then
+    recursive=(-r)
+  fi
+
+  print_status "Copying '$local_path' to '$remote_path' in the codespace..."
+  if ! _gh cs cp -c "$CODESPACE_NAME" "${recursive[@]}" -- "$local_path" "remote:$remote_path" >/dev/null 2>&1; then
+    print_error "Failed to copy '$local_path' to the codespace"
+    return 1
+  fi
+}
+
+# Write an OpenSSH config entry for the codespace to <personalization.ssh_config_dir>/<codespace>.conf,
+# so plain ssh, scp and editors can connect (add "Include <dir>/*.conf" to ~/.ssh/config)
+# Usage: codespace_write_ssh_config
+# Returns 1 when the entry could not be written
+codespace_write_ssh_config() {
+  local config_dir
+  local ssh_config
+
+  config_dir=$(_config_get personalization.ssh_config_dir)
+  if [ -z "$config_dir" ]; then
+    return 0
+  fi
+  config_dir=${config_dir/#\~/$HOME}
+
+  print_status "Writing SSH config for '$CODESPACE_NAME' to $config_dir/$CODESPACE_NAME.conf..."
+  if ! ssh_config=$(_gh cs ssh -c "$CODESPACE_NAME" --config 2>/dev/null); then
+    print_warning "Failed to generate the SSH config for the codespace."
+    return 1
+  fi
+  if [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+  if ! mkdir -p "$config_dir" 2>/dev/null || ! printf '%s\n' "$ssh_config" >"$config_dir/$CODESPACE_NAME.conf"; then
+    print_warning "Failed to write $config_dir/$CODESPACE_NAME.conf"
+    return 1
+  fi
+}
+
+# Step 4: Personalization phase: terminfo, dotfiles and SSH config run concurrently. They only
+# add comfort, so failures are reported as warnings, except a failed terminfo upload with
+# --terminfo-required. The terminfo upload is left out with --no-terminfo. The output of each
+# task is shown as a block once all finished, and their retries count towards the attempts of
+# the step.
+# Usage: codespace_personalize
+# Returns 1 when the terminfo upload failed and TERMINFO_REQUIRED is true
+codespace_personalize() {
+  local started
+  local results_dir
+  local retries
+  local i
+  local failed=0
+  local terminfo_failed=false
+  local -a tasks=(codespace_copy_dotfiles codespace_write_ssh_config)
+  local -a pids=()
+
+  if [ "$TERMINFO" = true ]; then
+    tasks=(codespace_upload_terminfo "${tasks[@]}")
+  fi
+
+  started=$(date +%s)
+  results_dir=$(mktemp -d "${TMPDIR:-/tmp}/codespace-personalize.XXXXXX")
+  for i in "${!tasks[@]}"; do
+    # Retries are counted in the subshell, so they are handed back through a file
+    (
+      STEP_ATTEMPTS=0
+      status=0
+      "${tasks[$i]}" || status=$?
+      echo "$STEP_ATTEMPTS" >"$results_dir/$i.retries"
+      exit $status
+    ) >"$results_dir/$i.log" 2>&1 &
+    pids+=("$!")
+  done
+  for i in "${!pids[@]}"; do
+    if ! wait "${pids[$i]}"; then
+      failed=$((failed + 1))
+      if [ "${tasks[$i]}" = codespace_upload_terminfo ]; then
+        terminfo_failed=true
+      fi
+    fi
+    cat "$results_dir/$i.log" >&2
+    retries=$(cat "$results_dir/$i.retries" 2>/dev/null)
+    STEP_ATTEMPTS=$((STEP_ATTEMPTS + ${retries:-0}))
+  done
+  rm -rf "$results_dir"
+
+  if [ "$failed" -eq 0 ]; then
+    print_status "Personalization finished in $(($(date +%s) - started))s"
+  else
+    print_warning "Personalization finished in $(($(date +%s) - started))s with $failed failed task(s)"
+  fi
+
+  if [ "$terminfo_failed" = true ] && [ "$TERMINFO_REQUIRED" = true ]; then
+    print_error "The terminfo upload failed and --terminfo-required is set"
+    return 1
+  fi
+}
+
+# Fast-forward a checked out branch to origin, since a codespace cloned from a prebuild
+# snapshot can be behind the remote branch. A branch that can't be fast-forwarded only warns.
+# Usage: _pull_branch <branch>
+_pull_branch() {
+  local branch=$1
+  local before
+  local count
+
+  before=$(_workspace_exec git rev-parse HEAD 2>/dev/null | tr -d '\r')
+  if ! _workspace_exec git pull --ff-only origin "$branch" >/dev/null 2>&1; then
+    print_warning "Could not fast-forward '$branch' to origin/$branch; it may have diverged"
+    return 0
+  fi
+
+  count=$(_workspace_exec git rev-list --count "$before..HEAD" 2>/dev/null | tr -d '\r')
+  if [ "${count:-0}" = 0 ]; then
+    print_status "Branch '$branch' is up to date with origin"
+  else
+    print_status "Fast-forwarded '$branch' by $count commit(s) from origin"
+  fi
+}
+
+# Publish a newly created branch with upstream tracking so teammates can see it and PRs can be opened
+# A failed push only warns; the branch stays checked out locally
+# Usage: _push_branch <branch>
+_push_branch() {
+  local branch=$1
+
+  print_status "Pushing new branch '$branch' to origin..."
+  if _workspace_exec git push -u origin "$branch" >/dev/null 2>&1; then
+    print_status "Published branch '$branch' with upstream tracking"
+    if [ "$branch" = "$BRANCH_NAME" ]; then
+      BRANCH_PUSHED=true
+    fi
+  else
+    print_warning "Failed to push branch '$branch'; push it later with: git push -u origin $branch"
+  fi
+}
+
+# Open a draft pull request for the branch this run created and published (--create-pr), against the
+# --stack-on parent or the default branch. pr.title and pr.body in the config file are templates
+# with {branch}, {title} (the --issue title, else the branch) and {issue} (the issue number);
+# the defaults are "{title}" and, with --issue, "Closes #{issue}". A failure only warns.
+# Usage: codespace_create_pr
+# Sets PR_URL
+codespace_create_pr() {
+  local default_body=""
+  local title
+  local body
+  local output
+  local base_flag=()
+
+  if [ "$BRANCH_PUSHED" != true ] && [ "$DRY_RUN" != true ]; then
+    print_warning "No new branch was pushed, so no draft pull request is opened (--create-pr)"
+    return 0
+  fi
+  if [ -n "$ISSUE_NUMBER" ]; then
+    default_body="Closes #{issue}"
+  fi
+  if [ -n "$STACK_ON" ]; then
+    base_flag=(--base "$STACK_ON")
+  fi
+  title=$(_render_pr_template "$(_config_get pr.title "{title}")")
+  body=$(_render_pr_template "$(_config_get pr.body "$default_body")")
+
+  print_status "Opening a draft pull request for '$BRANCH_NAME'..."
+  if ! output=$(_gh pr create -R "$REPO" --draft --head "$BRANCH_NAME" "${base_flag[@]}" --title "$title" --body "$body" 2>&1); then
+    print_warning "Failed to open a draft pull request for '$BRANCH_NAME'"
+    print_warning "$output"
+    if grep -q "No commits between" <<<"$output"; then
+      print_warning "GitHub needs at least one commit on the branch; commit, push and run: gh pr create --draft"
+    fi
+    return 0
+  fi
+  PR_URL=$(grep -o 'https://[^[:space:]]*/pull/[0-9]*' <<<"$output" | tail -n 1)
+  print_status "Opened draft pull request: ${PR_URL:-$output}"
+}
+
+# Fill in the {branch}, {title} and {issue} placeholders of a pr.title or pr.body template
+# Usage: _render_pr_template <template>
+_render_pr_template() {
+  local text=$1
+
+  text=${text//\{branch\}/$BRANCH_NAME}
+  text=${text//\{title\}/${ISSUE_TITLE:-$BRANCH_NAME}}
+  text=${text//\{issue\}/$ISSUE_NUMBER}
+  printf '%s' "$text"
+}
+
+# Check out a branch in the codespace, creating it from <start_point> (default: the current HEAD)
+# if it doesn't exist remotely
+# Usage: _checkout_or_create_branch <branch> [start_point]
+# Returns 1 if the checkout or creation fails
+_checkout_or_create_branch() {
+  local branch=$1
+  local start_point=${2:-}
+  local create_command=(git checkout -b "$branch")
+  local remote_check
+
+  print_status "Checking if branch '$branch' exists remotely..."
+  # A failed lookup must not be mistaken for a missing branch, or a new branch would be created
+  if ! remote_check=$(_workspace_exec git ls-remote --heads origin "refs/heads/$branch" 2>/dev/null); then
+    print_error "Failed to check whether branch '$branch' exists remotely"
+    return 1
+  fi
+
+  if [ -n "$remote_check" ]; then
+    print_status "Branch '$branch' exists remotely, checking out..."
+    if _workspace_exec git checkout "$branch" >/dev/null 2>&1; then
+      print_status "Successfully checked out branch '$branch' in codespace '$CODESPACE_NAME'"
+      if [ "$PULL" = true ]; then
+        _pull_branch "$branch"
+      fi
+    else
+      print_error "Failed to checkout branch '$branch'"
+      print_warning "Codespace '$CODESPACE_NAME' was created but branch checkout failed"
+      return 1
+    fi
+  else
+    # An explicit start point isn't set as upstream, so the new branch pushes to its own name
+    if [ -n "$start_point" ]; then
+      create_command+=(--no-track "$start_point")
+      print_warning "Branch '$branch' doesn't exist remotely. Creating new branch from '$start_point'..."
+    else
+      print_warning "Branch '$branch' doesn't exist remotely. Creating new branch..."
+    fi
+    if _workspace_exec "${create_command[@]}" >/dev/null 2>&1; then
+      print_status "Successfully created and checked out branch '$branch' in codespace '$CODESPACE_NAME'"
+      if [ "$PUSH" = true ]; then
+        _push_branch "$branch"
+      fi
+    else
+      print_error "Failed to create branch '$branch'"
+      print_warning "Codespace '$CODESPACE_NAME' was created but branch creation failed"
+      return 1
+    fi
+  fi
+}
+
+# Make a tag or commit available in the workspace. git fetch origin only brings tags that point
+# into fetched branches, and no commits outside them, so a ref the clone doesn't know is fetched
+# on its own: as a tag first, then as a commit, which only works with the full SHA.
+# Usage: _fetch_ref <ref>
+# Returns 1 when the ref is neither in the clone nor on origin
+_fetch_ref() {
+  local ref=$1
+
+  if _workspace_exec git rev-parse --verify --quiet "$ref^{commit}" >/dev/null 2>&1; then
+    return 0
+  fi
+  if _workspace_exec git fetch --no-tags origin "refs/tags/$ref:refs/tags/$ref" >/dev/null 2>&1; then
+    return 0
+  fi
+  [[ "$ref" =~ ^[0-9a-f]{40}$ ]] &&
+    _workspace_exec git fetch --no-tags origin "$ref" >/dev/null 2>&1 &&
+    _workspace_exec git rev-parse --verify --quiet "$ref^{commit}" >/dev/null 2>&1
+}
+
+# Check that a --base ref exists in the workspace, fetching a tag or commit the clone doesn't
+# have yet (an empty ref always passes)
+# Usage: _verify_base_ref <base_ref>
+# Returns 1 when the ref was not found
+_verify_base_ref() {
+  local base=$1
+
+  if [ -n "$base" ] && ! _fetch_ref "$base"; then
+    print_error "Base ref '$base' was not found in the codespace or on origin"
+    if [[ "$base" =~ ^[0-9a-f]{7,39}$ ]]; then
+      print_warning "Commits the clone doesn't have can only be fetched by their full 40-character SHA"
+    elif [[ "$base" != origin/* ]]; then
+      print_warning "Remote branches are only available as origin/<branch>, e.g. --base origin/$base"
+    fi
+    return 1
+  fi
+}
+
+# Step 5 (--ref): check out a tag or commit with a detached HEAD instead of a branch. A branch
+# name is rejected, since -b checks it out with tracking; nothing is pulled or pushed.
+# Usage: codespace_checkout_ref <ref>
+# Returns 1 when the ref is a branch, was not found or could not be checked out
+codespace_checkout_ref() {
+  local ref=$1
+  local kind=commit
+
+  if [ "$DRY_RUN" != true ] &&
+    _workspace_exec git show-ref --verify --quiet "refs/remotes/origin/$ref" >/dev/null 2>&1; then
+    print_error "'$ref' is a branch; check it out with -b $ref"
+    return 1
+  fi
+
+  print_status "Looking up '$ref'..."
+  if ! _fetch_ref "$ref"; then
+    print_error "'$ref' is not a tag or commit in the codespace or on origin"
+    if [[ "$ref" =~ ^[0-9a-f]{7,39}$ ]]; then
+      print_warning "Commits the clone doesn't have can only be fetched by their full 40-character SHA"
+    fi
+    return 1
+  fi
+  if _workspace_exec git show-ref --verify --quiet "refs/tags/$ref" >/dev/null 2>&1; then
+    kind=tag
+  fi
+
+  if ! _workspace_exec git checkout --detach "$ref^{commit}" >/dev/null 2>&1; then
+    print_error "Failed to check out $kind '$ref'"
+    print_warning "Codespace '$CODESPACE_NAME' was created but the checkout failed"
+    return 1
+  fi
+  print_status "Checked out $kind '$ref' with a detached HEAD in codespace '$CODESPACE_NAME'"
+}
+
+# Step 5: Checkout the branch, optionally stacked on top of a parent branch
+# Usage: codespace_checkout <branch> [parent_branch] [base_ref]
+# New branches are created from <base_ref> (e.g. origin/main, fetched by codespace_fetch) when
+# given, otherwise from the HEAD the codespace started on. With a parent, the base applies to
+# the parent and the branch is created on top of the parent.
+# Returns 1 if the base ref doesn't exist or the parent or the branch could not be checked out
+codespace_checkout() {
+  local branch=$1
+  local parent=${2:-}
+  local base=${3:-}
+
+  _verify_base_ref "$base" || return 1
+
+  # Stacked branches: make sure the parent is checked out first so a new child branch starts from it
+  if [ -n "$parent" ]; then
+    print_status "Stacking '$branch' on parent branch '$parent'..."
+    _checkout_or_create_branch "$parent" "$base" || return 1
+    _checkout_or_create_branch "$branch" || return 1
+  else
+    _checkout_or_create_branch "$branch" "$base" || return 1
+  fi
+
+  if [ -n "$parent" ]; then
+    if _workspace_exec git config "branch.$branch.description" "stacked on $parent" >/dev/null 2>&1; then
+      print_status "Recorded stack relationship: '$branch' is stacked on '$parent'"
+    else
+      print_warning "Failed to record stack relationship in the description of branch '$branch'"
+    fi
+  fi
+}
+
+# Step 5 (--fork): check out a branch that lives on a fork, such as a contributor's pull request.
+# The fork is added as a remote named after its owner (or its URL updated) and the branch is
+# fetched from it and checked out tracking the fork, so git pull and git push go there. When
+# origin has a branch of the same name, the local branch is named <owner>-<branch> instead, the
+# way gh pr checkout avoids clobbering it. A branch checked out earlier is fast-forwarded.
+# Usage: codespace_checkout_fork <owner/repo> <branch>
+# Sets BRANCH_NAME to the local branch; returns 1 if the branch could not be fetched or checked out
+codespace_checkout_fork() {
+  local fork=$1
+  local branch=$2
+  local remote=${fork%%/*}
+  local local_branch=$branch
+  local url="https://${GH_HOST:-github.com}/$fork.git"
+
+  print_status "Adding the fork $fork as remote '$remote'..."
+  if ! _workspace_exec git remote add "$remote" "$url" >/dev/null 2>&1 &&
+    ! _workspace_exec git remote set-url "$remote" "$url" >/dev/null 2>&1; then
+    print_error "Failed to add remote '$remote' for $fork"
+    return 1
+  fi
+  if ! _workspace_exec git fetch "$remote" "+refs/heads/$branch:refs/remotes/$remote/$branch" >/dev/null 2>&1; then
+    print_error "Failed to fetch branch '$branch' from $fork"
+    print_warning "Check that the branch exists and that the codespace can read $fork"
+    return 1
+  fi
+
+  if [ "$DRY_RUN" != true ] &&
+    _workspace_exec git show-ref --verify --quiet "refs/remotes/origin/$branch" >/dev/null 2>&1; then
+    local_branch="$remote-$branch"
+    print_warning "origin also has a branch '$branch'; checking out the fork's branch as '$local_branch'"
+  fi
+
+  if _workspace_exec git checkout -b "$local_branch" --track "$remote/$branch" >/dev/null 2>&1; then
+    print_status "Checked out branch '$local_branch' tracking '$remote/$branch' in codespace '$CODESPACE_NAME'"
+  elif _workspace_exec git checkout "$local_branch" >/dev/null 2>&1; then
+    print_status "Checked out existing branch '$local_branch' in codespace '$CODESPACE_NAME'"
+    if [ "$PULL" = true ] && ! _workspace_exec git merge --ff-only "$remote/$branch" >/dev/null 2>&1; then
+      print_warning "Could not fast-forward '$local_branch' to $remote/$branch; it may have diverged"
+    fi
+  else
+    print_error "Failed to check out branch '$branch' of $fork"
+    print_warning "Codespace '$CODESPACE_NAME' was created but branch checkout failed"
+    return 1
+  fi
+  if [ "$local_branch" != "$branch" ]; then
+    print_status "Push to the fork with: git push $remote HEAD:$branch"
+  fi
+  BRANCH_NAME=$local_branch
+}
+
+# Path of the worktree for a branch: /workspaces/<repo>-<branch>, with / in the branch replaced
+# Usage: _worktree_path <branch>
+_worktree_path() {
+  echo "${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}-${1//\//-}"
+}
+
+# Step 5 (--worktree): add a git worktree for the branch next to the main checkout instead of
+# switching the main checkout, so one codespace can hold several branches at once. The branch
+# is checked out from origin when it exists there, otherwise created from <base_ref> (default:
+# the HEAD of the main checkout). Later steps use the worktree as the workspace directory.
+# Usage: codespace_add_worktree <branch> [base_ref]
+# Sets WORKSPACE_DIR; returns 1 when the base ref doesn't exist or the worktree could not be added
+codespace_add_worktree() {
+  local branch=$1
+  local base=${2:-}
+  local path
+  local create_command
+  local remote_check
+
+  path=$(_worktree_path "$branch")
+  _verify_base_ref "$base" || return 1
+
+  print_status "Checking if branch '$branch' exists remotely..."
+  remote_check=$(_workspace_exec git ls-remote --heads origin "refs/heads/$branch" 2>/dev/null || echo "")
+
+  if [ -n "$remote_check" ]; then
+    print_status "Branch '$branch' exists remotely, adding a worktree at $path..."
+    create_command=(git worktree add "$path" "$branch")
+  elif [ -n "$base" ]; then
+    print_warning "Branch '$branch' doesn't exist remotely. Creating it from '$base' in a worktree at $path..."
+    create_command=(git worktree add --no-track -b "$branch" "$path" "$base")
+  else
+    print_warning "Branch '$branch' doesn't exist remotely. Creating it in a worktree at $path..."
+    create_command=(git worktree add -b "$branch" "$path")
+  fi
+
+  if ! _workspace_exec "${create_command[@]}" >/dev/null 2>&1; then
+    print_error "Failed to add a worktree for branch '$branch' at $path"
+    print_warning "The path may already exist, or the branch may be checked out in another worktree"
+    return 1
+  fi
+  WORKSPACE_DIR=$path
+  print_status "Branch '$branch' is checked out in the worktree at $path"
+
+  if [ -n "$remote_check" ] && [ "$PULL" = true ]; then
+    _pull_branch "$branch"
+  elif [ -z "$remote_check" ] && [ "$PUSH" = true ]; then
+    _push_branch "$branch"
+  fi
+}
+
+# Check the devcontainer lifecycle markers inside the codespace. The devcontainer CLI writes
+# ~/.devcontainer/.postStartCommandMarker when it starts postStartCommand, which is after the
+# onCreate, updateContent and postCreate commands finished; unlike the log text this doesn't
+# depend on the gh version or the locale. The marker lives in the home of the container user,
+# which isn't always the SSH user. A marker from before the last boot was left by a previous
+# start of the codespace and doesn't count.
+# Usage: _check_config_sentinel
+# Returns 1 when no current marker exists yet or the codespace couldn't be reached
+_check_config_sentinel() {
+  _remote_script 'boot=$(sed -n "s/^btime //p" /proc/stat 2>/dev/null)
+for home in "$HOME" /home/* /root; do
+  marker=$home/.devcontainer/.postStartCommandMarker
+  test -e "$marker" && [ "$(stat -c %Y "$marker")" -ge "${boot:-0}" ] && exit 0
+done
+exit 1' 2>/dev/null
+}
+
+# Helper function to check if configuration is complete
+# The API state is checked first so a failed or deleted codespace stops the wait immediately;
+# the last log line decides, and the lifecycle markers are only checked when it doesn't match
+_check_config_complete() {
+  local last_log
+  _check_codespace_available
+  case $? in
+  2) return 2 ;;
+  1) return 1 ;;
+  esac
+  last_log=$(_gh cs logs --codespace "$CODESPACE_NAME" 2>/dev/null | tail -n 1 || echo "")
+  [[ "$last_log" == *"Finished configuring codespace."* ]] || _check_config_sentinel
+}
+
+# Follow the configuration log stream (gh cs logs --follow) and show new lines as they arrive,
+# only those matching LOG_FILTER when it is set and none with --quiet-progress, until the
+# "Finished configuring codespace." line appears. Whenever the stream is quiet for 10
+# seconds, the API state is checked so a failed codespace stops the wait. The lifecycle
+# markers are left to the polling after the stream ends (see _check_config_complete): the
+# postStartCommand marker is written before the log line, while configuration still runs.
+# Usage: _follow_config_log <timeout_seconds>
+# Returns 0 when the marker was seen, 1 on timeout, 2 when the codespace failed and 3 when the
+# stream ended without the marker
+_follow_config_log() {
+  local timeout=$1
+  local deadline
+  local fd
+  local pid
+  local line
+  local status=1
+
+  deadline=$(($(date +%s) + timeout))
+  exec {fd}< <(COMMAND_TIMEOUT=0 _gh cs logs --codespace "$CODESPACE_NAME" --follow 2>/dev/null)
+  pid=$!
+  while [ "$(date +%s)" -lt "$deadline" ]; do
+    if IFS= read -r -t 10 -u "$fd" line; then
+      line=${line%$'\r'}
+      if [ "$QUIET_PROGRESS" != true ] && { [ -z "$LOG_FILTER" ] || [[ "$line" =~ $LOG_FILTER ]]; }; then
+        if [ "$PLAIN_OUTPUT" = true ]; then
+          _print_plain INFO "| $(_redact <<<"$line")"
+        else
+          echo "  | $(_redact <<<"$line")" >&2
+        fi
+      fi
+      if [[ "$line" == *"Finished configuring codespace."* ]]; then
+        status=0
+        break
+      fi
+    elif [ $? -gt 128 ]; then
+      if [ "$QUIET_PROGRESS" = true ]; then
+        _heartbeat "Waiting for codespace configuration"
+      fi
+      _check_codespace_available
+      if [ $? -eq 2 ]; then
+        status=2
+        break
+      fi
+      _rate_limit_pause 10
+    else
+      status=3
+      break
+    fi
+  done
+  exec {fd}<&-
+  kill "$pid" 2>/dev/null
+  return $status
+}
+
+# Limit the working tree of the workspace to a monorepo subdirectory (cone mode keeps the
+# files at the repository root). A failure only warns; the full checkout stays in place.
+# Usage: codespace_sparse_checkout <path>...
+codespace_sparse_checkout() {
+  print_status "Limiting the checkout to $* (git sparse-checkout)..."
+  if _workspace_exec git sparse-checkout set --cone -- "$@" >/dev/null 2>&1; then
+    print_status "Sparse checkout enabled; widen it later with: git sparse-checkout add <path>"
+  else
+    print_warning "Failed to set up sparse checkout; the full repository stays checked out"
+    return 1
+  fi
+}
+
+# Apply a patch of local changes (see --sync-diff) to the workspace, falling back to a
+# three-way merge when the checked out branch differs from the local base
+# Usage: codespace_apply_patch <patch_file>
+# Returns 1 when the patch doesn't apply
+codespace_apply_patch() {
+  local patch_file=$1
+
+  print_status "Applying local changes to the codespace..."
+  # The patch goes to git on stdin, so this is a single command instead of a workspace script
+  if ! _remote_exec git -C "${WORKSPACE_DIR:-/workspaces/$REPO_NAME}" apply --3way --whitespace=nowarn - <"$patch_file" >/dev/null 2>&1; then
+    print_error "Local changes don't apply cleanly to the branch in the codespace"
+    return 1
+  fi
+  print_status "Local changes applied (as uncommitted changes)"
+}
+
+# Check whether the dotfiles installation finished: the dotfiles.marker file exists when one is
+# configured, otherwise the dotfiles repository was cloned and none of its scripts still run
+# Usage: _check_dotfiles_installed
+_check_dotfiles_installed() {
+  _remote_script 'dotfiles=/workspaces/.codespaces/.persistedshare/dotfiles
+if [ -n "$1" ]; then
+  test -e "${1/#\~/$HOME}"
+  exit
+fi
+test -d "$dotfiles" && ! pgrep -f "$dotfiles/" >/dev/null' "$(_config_get dotfiles.marker)"
+}
+
+# Wait for the asynchronous dotfiles installation, so the shell configuration exists when setup
+# reports completion. Not finishing in time is only a warning: there may be no dotfiles repository.
+# Usage: codespace_wait_dotfiles
+# Returns 1 when the installation did not finish in time
+codespace_wait_dotfiles() {
+  print_status "Waiting for the dotfiles installation to complete..."
+  if ! retry_until 30 10 "Checking dotfiles installation" _check_dotfiles_installed; then
+    print_warning "Dotfiles installation did not complete after 30 attempts"
+    print_warning "Check that a dotfiles repository is configured in your Codespaces settings"
+    return 1
+  fi
+  print_status "Dotfiles installed${SYMBOL_OK:+ $SYMBOL_OK}"
+}
+
+# Step 6: Wait for codespace configuration to complete (and the dotfiles with --wait-dotfiles)
+# Usage: codespace_wait_configured
+# Returns 1 when configuration did not finish in time, 2 when the codespace failed
+codespace_wait_configured() {
+  local status
+
+  print_status "Waiting for codespace configuration to complete..."
+
+  status=0
+  _follow_config_log 600 || status=$?
+  if [ $status -eq 3 ]; then
+    # The log stream ended early (e.g. an older gh without --follow): poll the last line instead
+    status=0
+    retry_until 60 10 "Checking configuration status" _check_config_complete || status=$?
+  fi
+  if [ $status -eq 0 ]; then
+    print_status "Codespace configuration complete!${SYMBOL_OK:+ $SYMBOL_OK}"
+  elif [ $status -eq 2 ]; then
+    print_error "Codespace entered the '$CODESPACE_STATE' state during configuration"
+  else
+    print_warning "Codespace configuration did not complete in time"
+    print_warning "The codespace may still be configuring in the background"
+  fi
+  if [ $status -eq 0 ] && [ "$WAIT_DOTFILES" = true ]; then
+    codespace_wait_dotfiles
+  fi
+  return $status
+}
+
+# Open an interactive SSH session in the workspace
+# Usage: codespace_connect <record>
+# When <record> is true the session runs under script(1) and the transcript is stored inside
+# the codespace in session_recording.dir (default: /workspaces/.session-recordings)
+codespace_connect() {
+  local record=$1
+  local recording_dir
+  local script
+
+  if [ "$record" != true ] && [ -n "$WORKDIR" ]; then
+    print_status "Connecting to codespace '$CODESPACE_NAME' in $(_command_dir)..."
+    _remote_exec --tty bash -l -c 'cd "$1" && exec "${SHELL:-bash}" -l' bash "$(_command_dir)"
+    return
+  elif [ "$record" != true ]; then
+    print_status "Connecting to codespace '$CODESPACE_NAME'..."
+    COMMAND_TIMEOUT=0 _gh cs ssh -c "$CODESPACE_NAME"
+    return
+  fi
+
+  recording_dir=$(_config_get session_recording.dir "/workspaces/.session-recordings")
+  # The terminal needs stdin, so the constant script is passed with -c (the timestamp is taken
+  # inside the codespace when the session starts)
+  script='mkdir -p "$1" && cd "$2" && exec script -q -f "$1/session-$(date +%Y%m%d-%H%M%S).log"'
+
+  print_status "Connecting to codespace '$CODESPACE_NAME' (session recorded to $recording_dir inside the codespace)..."
+  _remote_exec --tty bash -l -c "$script" bash "$recording_dir" "$(_command_dir)"
+}
+
+# Open the codespace in JetBrains Gateway over SSH. gh has no JetBrains integration, so the
+# codespace's OpenSSH config is written to jetbrains.ssh_config_dir (default: ~/.ssh/codespaces)
+# and a Gateway deep link for that host is opened (or printed when there is no URL opener)
+# Usage: codespace_open_jetbrains
+# Returns 1 when the SSH config could not be generated or written
+codespace_open_jetbrains() {
+  local config_dir
+  local ssh_config
+  local host
+  local user
+  local link
+
+  config_dir=$(_config_get jetbrains.ssh_config_dir "$HOME/.ssh/codespaces")
+  config_dir=${config_dir/#\~/$HOME}
+
+  if ! ssh_config=$(_gh cs ssh -c "$CODESPACE_NAME" --config 2>/dev/null); then
+    print_error "Failed to generate the SSH config for JetBrains Gateway"
+    return 1
+  fi
+  if [ "$DRY_RUN" = true ]; then
+    ssh_config=$'Host cs.dry-run-codespace\n\tUser codespace'
+  elif ! mkdir -p "$config_dir" 2>/dev/null || ! printf '%s\n' "$ssh_config" >"$config_dir/$CODESPACE_NAME.conf"; then
+    print_error "Failed to write $config_dir/$CODESPACE_NAME.conf"
+    return 1
+  fi
+  host=$(awk '$1 == "Host" { print $2; exit }' <<<"$ssh_config")
+  user=$(awk '$1 == "User" { print $2; exit }' <<<"$ssh_config")
+
+  link="jetbrains-gateway://connect#type=ssh&host=$host&port=22&user=${user:-codespace}&projectPath=$(_command_dir)"
+  print_status "Opening codespace '$CODESPACE_NAME' in JetBrains Gateway (SSH host '$host')..."
+  print_status "Gateway reads ~/.ssh/config: make sure it contains 'Include $config_dir/*.conf'"
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print xdg-open "$link"
+  elif command -v open >/dev/null 2>&1 && [ "$(uname -s)" = Darwin ]; then
+    open "$link"
+  elif [[ "$OSTYPE" == msys* || "$OSTYPE" == cygwin* ]]; then
+    # explorer.exe hands URLs to the registered handler without cmd.exe's quoting rules for '&'
+    explorer.exe "$link"
+  elif command -v xdg-open >/dev/null 2>&1; then
+    xdg-open "$link" >/dev/null 2>&1
+  else
+    print_warning "No URL opener found, open this link manually: $link"
+  fi
+}
+
+# Forward codespace ports to localhost in the background, so they stay forwarded after the
+# script exits. Ports are <remote>[:<local>] as in gh cs ports forward; the forwarder's output
+# is written to $STATE_DIR/ports/<codespace>.log and its PID to $STATE_DIR/ports/<codespace>.pid
+# Usage: codespace_forward_ports <port>...
+# Returns 1 when the forwarder could not be started or exited right away
+codespace_forward_ports() {
+  local ports_dir="$STATE_DIR/ports"
+  local mappings=()
+  local port
+  local pid
+
+  for port in "$@"; do
+    if [[ "$port" == *:* ]]; then
+      mappings+=("$port")
+    else
+      mappings+=("$port:$port")
+    fi
+  done
+
+  print_status "Forwarding ports ${mappings[*]} (remote:local) from codespace '$CODESPACE_NAME'..."
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print gh cs ports forward "${mappings[@]}" -c "$CODESPACE_NAME"
+    return 0
+  fi
+  if ! mkdir -p "$ports_dir" 2>/dev/null; then
+    print_error "Failed to create $ports_dir"
+    return 1
+  fi
+  nohup "$GH" cs ports forward "${mappings[@]}" -c "$CODESPACE_NAME" </dev/null >"$ports_dir/$CODESPACE_NAME.log" 2>&1 &
+  pid=$!
+  echo "$pid" >"$ports_dir/$CODESPACE_NAME.pid"
+
+  # A forwarder that exits right away (local port in use, unknown port) is reported instead of missed
+  sleep 2
+  if ! kill -0 "$pid" 2>/dev/null; then
+    print_error "Port forwarding stopped right away, see $ports_dir/$CODESPACE_NAME.log"
+    rm -f "$ports_dir/$CODESPACE_NAME.pid"
+    return 1
+  fi
+  print_status "Ports are forwarded in the background (PID $pid, log: $ports_dir/$CODESPACE_NAME.log)"
+  print_status "Stop forwarding with: kill $pid"
+}
+
+# Hand the rest of the setup to a background run of this script (--detach), so the
+# caller gets its terminal back as soon as the codespace exists
+# Usage: codespace_detach
+# Returns 1 when the background run could not be started
+codespace_detach() {
+  local logs_dir="$STATE_DIR/logs"
+  local continue_args=(-x --codespace "$CODESPACE_NAME" -R "$REPO" -m "$CODESPACE_SIZE" --devcontainer-path "$DEVCONTAINER_PATH")
+  local pid
+
+  if [ -n "$BRANCH_NAME" ]; then
+    continue_args+=(-b "$BRANCH_NAME")
+  fi
+  if [ -n "$FORK_REPO" ]; then
+    continue_args+=(--fork "$FORK_REPO")
+  fi
+  _state_save "detached"
+
+  if [ "$DRY_RUN" = true ]; then
+    _dry_run_print nohup "${BASH_SOURCE[0]}" "${ORIGINAL_ARGS[@]}" "${continue_args[@]}"
+  else
+    if ! mkdir -p "$logs_dir" 2>/dev/null; then
+      print_error "Failed to create $logs_dir"
+      return 1
+    fi
+    # Later options win, so the resolved values override anything chosen interactively
+    nohup "${BASH_SOURCE[0]}" "${ORIGINAL_ARGS[@]}" "${continue_args[@]}" </dev/null >"$logs_dir/$CODESPACE_NAME.log" 2>&1 &
+    pid=$!
+    print_status "Setup continues in the background (PID $pid, log: $logs_dir/$CODESPACE_NAME.log)"
+    print_status "Follow it with: tail -f $logs_dir/$CODESPACE_NAME.log"
+  fi
+  print_status "Check readiness with: $PROG status $CODESPACE_NAME"
+
+  _print_result detached
+}
+
+# Print the result of a run on stdout; progress goes to stderr, so NAME=$(create-codespace-and-checkout ...) works.
+# The result is the --json summary, or the codespace name with --print-name or when stdout
+# is not a terminal
+# Usage: _print_result [status]
+_print_result() {
+  # With --output ndjson, stdout is the event stream and the result is its last event
+  if [ -n "$OUTPUT_FORMAT" ]; then
+    return 0
+  fi
+  if [ "$PRINT_NAME" = true ] || { [ "$JSON_OUTPUT" = false ] && [ ! -t 1 ]; }; then
+    echo "$CODESPACE_NAME"
+  elif [ "$JSON_OUTPUT" = true ]; then
+    _print_json_summary "$@"
+  fi
+}
+
+# Step 8: Open the codespace in an editor or an SSH session
+# Usage: codespace_open <target> <record>
+# <target> is vscode, web, jetbrains, ssh or none; <record> is passed on to codespace_connect for ssh
+codespace_open() {
+  local target=$1
+  local record=$2
+
+  case "$target" in
+  vscode)
+    print_status "Opening codespace '$CODESPACE_NAME' in Visual Studio Code..."
+    _gh cs code -c "$CODESPACE_NAME"
+    ;;
+  web)
+    print_status "Opening codespace '$CODESPACE_NAME' in the browser editor..."
+    _gh cs code -c "$CODESPACE_NAME" --web
+    ;;
+  jetbrains)
+    codespace_open_jetbrains
+    ;;
+  ssh)
+    codespace_connect "$record"
+    ;;
+  none) ;;
+  esac
+}
+
+# Read an integer retention rule from the config file, ignoring (with a warning) invalid values
+# Usage: _retention_rule <key>
+_retention_rule() {
+  local value
+  value=$(_config_get "$1")
+  if [ -n "$value" ] && ! [[ "$value" =~ ^[0-9]+$ ]]; then
+    print_warning "Ignoring $1 = $value in $CONFIG_FILE (expected a whole number)"
+    value=""
+  fi
+  echo "$value"
+}
+
+# Run a post-setup shell command (e.g. script/bootstrap) in the workspace directory, streaming
+# its output to stderr so it doesn't mix with --json output
+# Usage: codespace_run <command>
+# Returns 1 when the command fails
+codespace_run() {
+  local command=$1
+
+  print_status "Running '$command' in codespace '$CODESPACE_NAME'..."
+  # Setup commands like script/bootstrap may legitimately run for a long time
+  if ! COMMAND_TIMEOUT=0 _remote_script 'cd "$1" || exit 1
+eval "$2"' "$(_command_dir)" "$command" >&2; then
+    print_error "Command '$command' failed"
+    return 1
+  fi
+  print_status "Command '$command' finished"
+}
+
+# Run the lifecycle hooks configured for a stage in the config file:
+#   hooks.<stage>.local = <command>    runs on this machine
+#   hooks.<stage>.remote = <command>   runs in the workspace directory of the codespace (post-checkout
+#                                      hooks in the --workdir subdirectory)
+# Both get CODESPACE_NAME, CODESPACE_REPO, CODESPACE_BRANCH, CODESPACE_MACHINE and
+# CODESPACE_HOOK in their environment. Stages: pre-create (local only), post-ready, post-checkout.
+# Usage: _run_hooks <stage>
+# Returns 1 when a hook fails
+_run_hooks() {
+  local stage=$1
+  local local_hook
+  local remote_hook
+  local dir=${WORKSPACE_DIR:-/workspaces/$REPO_NAME}
+
+  local_hook=$(_config_get "hooks.$stage.local")
+  remote_hook=$(_config_get "hooks.$stage.remote")
+
+  if [ -n "$local_hook" ]; then
+    print_status "Running local $stage hook: $local_hook"
+    if [ "$DRY_RUN" = true ]; then
+      _dry_run_print bash -c "$local_hook"
+    elif ! CODESPACE_NAME="${CODESPACE_NAME:-}" CODESPACE_REPO="$REPO" CODESPACE_BRANCH="$BRANCH_NAME" \
+      CODESPACE_MACHINE="$CODESPACE_SIZE" CODESPACE_HOOK="$stage" bash -c "$local_hook" </dev/null >&2; then
+      print_error "The local $stage hook failed"
+      return 1
+    fi
+  fi
+
+  if [ -n "$remote_hook" ]; then
+    if [ -z "${CODESPACE_NAME:-}" ]; then
+      print_warning "Ignoring hooks.$stage.remote: there is no codespace yet at this stage"
+      return 0
+    fi
+    print_status "Running remote $stage hook: $remote_hook"
+    if [ "$stage" = post-checkout ]; then
+      dir=$(_command_dir)
+    fi
+    if ! COMMAND_TIMEOUT=0 _remote_script 'cd "$1" || exit 1
+export CODESPACE_NAME=$2 CODESPACE_REPO=$3 CODESPACE_BRANCH=$4 CODESPACE_MACHINE=$5 CODESPACE_HOOK=$6
+eval "$7"' "$dir" "$CODESPACE_NAME" "$REPO" "$BRANCH_NAME" \
+      "$CODESPACE_SIZE" "$stage" "$remote_hook" >&2; then
+      print_error "The remote $stage hook failed"
+      return 1
+    fi
+  fi
+}
+
+# Step 7: Apply the retention policy from the config file to the codespaces of a repository
+# Usage: codespace_gc <repo> <keep_codespace> <execute>
+# Rules: retention.max_per_repo, retention.max_age_days, retention.max_stopped_days.
+# Codespaces breaking a rule are listed, and deleted when <execute> is true. The
+# <keep_codespace> (usually the one just created) is never proposed for deletion.
+codespace_gc() {
+  local repo=$1
+  local keep=$2
+  local execute=$3
+  local max_per_repo
+  local max_age_days
+  local max_stopped_days
+  local codespaces
+  local name state age_days idle_days
+  local reason
+  local index=0
+  local candidates=0
+
+  max_per_repo=$(_retention_rule retention.max_per_repo)
+  max_age_days=$(_retention_rule retention.max_age_days)
+  max_stopped_days=$(_retention_rule retention.max_stopped_days)
+
+  if [ -z "$max_per_repo" ] && [ -z "$max_age_days" ] && [ -z "$max_stopped_days" ]; then
+    return 0
+  fi
+
+  print_status "Checking retention policy for $repo..."
+
+  # Most recently used first, with ages in whole days computed by gh's built-in jq
+  if ! codespaces=$(_gh cs list -R "$repo" --json name,state,createdAt,lastUsedAt --jq '
+    def days(t): (now - (t | sub("\\.[0-9]+"; "") | fromdateiso8601)) / 86400 | floor;
+    sort_by(.lastUsedAt) | reverse | .[] | [.name, .state, days(.createdAt), days(.lastUsedAt)] | @tsv' 2>&1); then
+    print_warning "Could not list codespaces to apply the retention policy"
+    print_warning "$codespaces"
+    return 1
+  fi
+
+  while IFS=$'\t' read -r name state age_days idle_days; do
+    [ -z "$name" ] && continue
+    index=$((index + 1))
+    [ "$name" = "$keep" ] && continue
+
+    reason=""
+    if [ -n "$max_per_repo" ] && [ "$index" -gt "$max_per_repo" ]; then
+      reason="more than $max_per_repo codespaces for $repo"
+    elif [ -n "$max_age_days" ] && [ "$age_days" -gt "$max_age_days" ]; then
+      reason="created $age_days days ago (max $max_age_days)"
+    elif [ -n "$max_stopped_days" ] && [ "$state" = "Shutdown" ] && [ "$idle_days" -gt "$max_stopped_days" ]; then
+      reason="stopped for $idle_days days (max $max_stopped_days)"
+    fi
+    [ -z "$reason" ] && continue
+
+    candidates=$((candidates + 1))
+    if [ "$execute" = true ]; then
+      if _gh cs delete -c "$name" >/dev/null 2>&1; then
+        print_status "Deleted codespace '$name': $reason"
+      else
+        print_warning "Failed to delete codespace '$name' ($reason); it may have unsaved changes"
+      fi
+    else
+      print_warning "Retention policy: codespace '$name' should be deleted: $reason"
+    fi
+  done <<<"$codespaces"
+
+  if [ "$candidates" -eq 0 ]; then
+    print_status "All codespaces for $repo are within the retention policy"
+  elif [ "$execute" != true ]; then
+    print_status "Pass --auto-gc on the next run to delete them automatically, or use: gh cs delete -c <name>"
+  fi
+}
+
+# Estimate the ongoing cost of the codespace from its machine and the prices in the config
+# file (pricing.core_hour, pricing.storage_gb_month; defaults are GitHub's list prices), and
+# describe how long it keeps running and is retained. Sets the COST_* globals for the summary.
+# Usage: codespace_cost_estimate
+# Returns 1 when the codespace details could not be fetched
+codespace_cost_estimate() {
+  local details
+  local cpus
+  local storage_gb
+  local retention_minutes
+  local age_seconds
+  local core_hour
+  local storage_gb_month
+  local description
+
+  details=$(_gh api "/user/codespaces/$CODESPACE_NAME" --jq '
+    [.machine.cpus, (.machine.storage_in_bytes / 1000000000 | floor), (.idle_timeout_minutes // ""),
+     (.retention_period_minutes // ""), (now - (.created_at | sub("\\.[0-9]+"; "") | fromdateiso8601) | floor)] | @tsv' 2>/dev/null)
+  if [ -z "$details" ]; then
+    return 1
+  fi
+  IFS=$'\t' read -r cpus storage_gb COST_IDLE_TIMEOUT_MINUTES retention_minutes age_seconds <<<"$details"
+
+  core_hour=$(_config_get pricing.core_hour 0.09)
+  storage_gb_month=$(_config_get pricing.storage_gb_month 0.07)
+  COST_HOURLY=$(awk -v c="$cpus" -v p="$core_hour" 'BEGIN { printf "%.2f", c * p }')
+  COST_DAILY=$(awk -v h="$COST_HOURLY" 'BEGIN { printf "%.2f", h * 24 }')
+  COST_STORAGE_MONTHLY=$(awk -v g="$storage_gb" -v p="$storage_gb_month" 'BEGIN { printf "%.2f", g * p }')
+  COST_SO_FAR=$(awk -v h="$COST_HOURLY" -v m="$COST_STORAGE_MONTHLY" -v s="$age_seconds" \
+    'BEGIN { printf "%.2f", h * s / 3600 + m * s / (30 * 86400) }')
+  COST_RETENTION_DAYS=""
+  if [ -n "$retention_minutes" ]; then
+    COST_RETENTION_DAYS=$((retention_minutes / 1440))
+  fi
+
+  description="$SYMBOL_APPROX\$$COST_HOURLY/hour while running ($SYMBOL_APPROX\$$COST_DAILY/day if left running)"
+  description+=", $SYMBOL_APPROX\$$COST_STORAGE_MONTHLY/month storage for ${storage_gb} GB, $SYMBOL_APPROX\$$COST_SO_FAR so far"
+  if [ -n "$COST_IDLE_TIMEOUT_MINUTES" ]; then
+    description+=", auto-stops after $COST_IDLE_TIMEOUT_MINUTES min idle"
+  fi
+  if [ -n "$COST_RETENTION_DAYS" ]; then
+    description+=", retained $COST_RETENTION_DAYS days after stopping"
+  fi
+  print_status "Estimated cost: $description"
+}
+
+# Print the result of the run as a JSON object on stdout (all other output goes to stderr)
+# Usage: _print_json_summary
+_print_json_summary() {
+  local status=${1:-complete}
+  local cost="null"
+  local cancel_reason="null"
+
+  if [ -n "$COST_HOURLY" ]; then
+    cost="{\"hourly\":$COST_HOURLY,\"daily_if_running\":$COST_DAILY,\"storage_monthly\":$COST_STORAGE_MONTHLY,\"so_far\":$COST_SO_FAR"
+    cost+=",\"idle_timeout_minutes\":${COST_IDLE_TIMEOUT_MINUTES:-null},\"retention_days\":${COST_RETENTION_DAYS:-null}}"
+  fi
+  if [ -n "$CANCEL_REASON" ]; then
+    cancel_reason=$(_json_string "$CANCEL_REASON")
+  fi
+  printf '{"codespace":%s,"repo":%s,"branch":%s,"machine":%s,"devcontainer_path":%s,"status":%s,"cancel_reason":%s,"cost":%s}\n' \
+    "$(_json_string "${CODESPACE_NAME:-}")" "$(_json_string "$REPO")" "$(_json_string "$BRANCH_NAME")" \
+    "$(_json_string "$CODESPACE_SIZE")" "$(_json_string "$DEVCONTAINER_PATH")" "$(_json_string "$status")" \
+    "$cancel_reason" "$cost"
+}
+
+# Encode a value as a JSON string
+# Usage: _json_string <value>
+_json_string() {
+  local value=$1
+
+  value=${value//\\/\\\\}
+  value=${value//\"/\\\"}
+  value=${value//$'\n'/\\n}
+  value=${value//$'\r'/\\r}
+  value=${value//$'\t'/\\t}
+  printf '"%s"' "$value"
+}
+
+# Show a native desktop notification: osascript on macOS, notify-send on Linux and a
+# PowerShell balloon tip on Windows (Git Bash, MSYS2, Cygwin)
+# Usage: _desktop_notify <title> <body>
+# Returns 1 when no notification mechanism is available or it failed
+_desktop_notify() {
+  local title=$1
+  local body=$2
+
+  if [ "$(uname -s)" = Darwin ]; then
+    osascript -e 'on run argv' -e 'display notification (item 2 of argv) with title (item 1 of argv)' \
+      -e 'end run' "$title" "$body" >/dev/null 2>&1
+  elif [[ "$OSTYPE" == msys* || "$OSTYPE" == cygwin* ]]; then
+    # The text goes through the environment, so it is never parsed as PowerShell code; the
+    # balloon needs the process to stay alive for a moment, so it runs in the background
+    NOTIFY_TITLE=$title NOTIFY_BODY=$body powershell.exe -NoProfile -NonInteractive -Command '
+      Add-Type -AssemblyName System.Windows.Forms
+      $icon = New-Object System.Windows.Forms.NotifyIcon
+      $icon.Icon = [System.Drawing.SystemIcons]::Information
+      $icon.Visible = $true
+      $icon.ShowBalloonTip(10000, $env:NOTIFY_TITLE, $env:NOTIFY_BODY, "Info")
+      Start-Sleep -Seconds 10
+      $icon.Dispose()' >/dev/null 2>&1 &
+  elif command -v notify-send >/dev/null 2>&1; then
+    notify-send --app-name "$DIST_NAME" "$title" "$body" >/dev/null 2>&1
+  else
+    return 1
+  fi
+}
+
+# Send a codespace lifecycle event to the notifier sinks configured in the config file:
+#   notify.webhook = <url>       the event is POSTed as JSON
+#   notify.command = <command>   the command runs with the event JSON on stdin
+#   notify.desktop = true        a desktop notification is shown (also enabled by --notify)
+# Events are JSON objects with event, codespace, repo, message and time fields, plus a
+# reason field when a <reason> is given (see CANCEL_REASON).
+# Usage: _notify <event> <codespace> <repo> <message> [reason]
+_notify() {
+  local event=$1
+  local codespace=$2
+  local repo=$3
+  local message=$4
+  local reason=${5:-}
+  local payload
+  local webhook
+  local command
+
+  print_status "$message"
+
+  payload="{\"event\":$(_json_string "$event"),\"codespace\":$(_json_string "$codespace"),\"repo\":$(_json_string "$repo"),\"message\":$(_json_string "$message")"
+  if [ -n "$reason" ]; then
+    payload+=",\"reason\":$(_json_string "$reason")"
+  fi
+  payload+=",\"time\":\"$(date -u '+%Y-%m-%dT%H:%M:%SZ')\"}"
+
+  webhook=$(_config_get notify.webhook)
+  if [ -n "$webhook" ] &&
+    ! curl -fsS -X POST -H "Content-Type: application/json" --data "$payload" "$webhook" >/dev/null 2>&1; then
+    print_warning "Failed to send the '$event' event to the notify.webhook URL"
+  fi
+
+  command=$(_config_get notify.command)
+  if [ -n "$command" ] && ! bash -c "$command" <<<"$payload" >/dev/null 2>&1; then
+    print_warning "The notify.command failed for the '$event' event"
+  fi
+
+  if [ "$NOTIFY_DESKTOP" = true ] || [ "$(_config_get notify.desktop false)" = true ]; then
+    # Runs that end early or complete say how to get into the codespace
+    if [ -n "$codespace" ] && [[ "$event" == complete || "$event" == cancelled ]]; then
+      message+=$'\n'"Connect with: gh cs ssh -c $codespace"
+    fi
+    if ! _desktop_notify "$DIST_NAME: $event" "$message"; then
+      print_warning "Could not show a desktop notification (no osascript, notify-send or PowerShell found)"
+    fi
+  fi
+}
+
+# Telemetry (opt-in)
+#
+# Off unless telemetry.enabled = true (see the telemetry command). Each run of the create flow
+# produces one record, kept in $STATE_DIR/telemetry/runs.tsv for the stats command and POSTed
+# as JSON to telemetry.endpoint when that is set. Records are assembled only by
+# _telemetry_record from allowlisted fields; every value passes _telemetry_value, and the
+# repository and branch names are only added with telemetry.include_names = true.
+
+# Step names that may appear in telemetry records
+TELEMETRY_PHASE_NAMES=" pre-create secrets create wait-ready post-ready copy layout fetch personalization checkout post-checkout sync-diff sparse-checkout wait-configured forward-ports run gc "
+
+# Pass a value into a telemetry record only when it is a plain token (letters, digits, . _ : -);
+# anything else, such as a path or free text, is replaced with "redacted"
+# Usage: _telemetry_value <value>
+_telemetry_value() {
+  if [[ "$1" =~ ^[A-Za-z0-9._:-]*$ ]]; then
+    echo "$1"
+  else
+    echo "redacted"
+  fi
+}
+
+# List the options the run used (names only, never their values), comma-separated
+# Usage: _telemetry_features
+_telemetry_features() {
+  local features=()
+
+  [ -n "$BRANCH_NAME" ] && features+=(branch)
+  [ -n "$STACK_ON" ] && features+=(stack-on)
+  [ -n "$BASE_REF" ] && features+=(base)
+  [ -n "$CHECKOUT_REF" ] && features+=(ref)
+  [ -n "$FORK_REPO" ] && features+=(fork)
+  [ -n "$PR_NUMBER" ] && features+=(pr)
+  [ "$WORKTREE" = true ] && features+=(worktree)
+  [ -n "$CODESPACE_LOCATION" ] && features+=(location)
+  [ "$IMMEDIATE_MODE" = true ] && features+=(immediate)
+  [ "$SPARSE_CHECKOUT" = true ] && features+=(sparse-checkout)
+  [ "$SYNC_DIFF" = true ] && features+=(sync-diff)
+  [ "$PUSH" = true ] && features+=(push)
+  [ "$JSON_OUTPUT" = true ] && features+=(json)
+  [ "$QUIET_PROGRESS" = true ] && features+=(quiet-progress)
+  [ "$WAIT_DOTFILES" = true ] && features+=(wait-dotfiles)
+  [ "$WAIT_UNTIL" = ready ] && features+=(no-wait)
+  [ "$AUTO_GC" = true ] && features+=(auto-gc)
+  [ "$CLEANUP_ON_FAILURE" = true ] && features+=(cleanup-on-failure)
+  [ "$OPEN_TARGET" != none ] && features+=("open-$OPEN_TARGET")
+  [ ${#COPY_SPECS[@]} -gt 0 ] && features+=(copy)
+  [ ${#RUN_COMMANDS[@]} -gt 0 ] && features+=(run)
+  [ ${#SECRETS[@]} -gt 0 ] && features+=(secrets)
+  [ ${#FORWARD_PORTS[@]} -gt 0 ] && features+=(forward-ports)
+  local IFS=,
+  echo "${features[*]}"
+}
+
+# Record the finished run when telemetry is enabled (never for --dry-run)
+# Usage: _telemetry_record
+_telemetry_record() {
+  local telemetry_dir="$STATE_DIR/telemetry"
+  local status=complete
+  local duration
+  local phase
+  local phases=""
+  local phases_json=""
+  local repo=""
+  local branch=""
+  local features
+  local machine
+  local reason
+  local endpoint
+  local payload
+
+  if [ "$(_config_get telemetry.enabled false)" != true ] || [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+
+  if [ -n "$CURRENT_STEP" ] && [ "$PHASE_STARTED_AT" -gt 0 ]; then
+    TELEMETRY_PHASES+=("$CURRENT_STEP=$(($(date +%s) - PHASE_STARTED_AT))")
+  fi
+  for phase in "${TELEMETRY_PHASES[@]}"; do
+    if [[ "$TELEMETRY_PHASE_NAMES" == *" ${phase%%=*} "* ]] && [[ "${phase#*=}" =~ ^[0-9]+$ ]]; then
+      phases+="${phases:+,}$phase"
+      phases_json+="${phases_json:+,}{\"phase\":\"${phase%%=*}\",\"seconds\":${phase#*=}}"
+    fi
+  done
+  if [ -n "$CANCEL_REASON" ]; then
+    status=cancelled
+  fi
+  duration=$(($(date +%s) - RUN_STARTED_AT))
+  features=$(_telemetry_features)
+  machine=$(_telemetry_value "$CODESPACE_SIZE")
+  reason=$(_telemetry_value "$CANCEL_REASON")
+  if [ "$(_config_get telemetry.include_names false)" = true ]; then
+    repo=$REPO
+    branch=$BRANCH_NAME
+  fi
+
+  if mkdir -p "$telemetry_dir" 2>/dev/null; then
+    printf '%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n' "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" "$status" "$reason" \
+      "$duration" "$machine" "$features" "$phases" "${repo//$'\t'/ }" "${branch//$'\t'/ }" >>"$telemetry_dir/runs.tsv"
+  fi
+
+  endpoint=$(_config_get telemetry.endpoint)
+  if [ -n "$endpoint" ]; then
+    payload="{\"status\":\"$status\",\"cancel_reason\":\"$reason\",\"duration_seconds\":$duration,\"machine\":\"$machine\""
+    payload+=",\"features\":[$(sed -E 's/([^,]+)/"\1"/g' <<<"$features")],\"phases\":[$phases_json]"
+    if [ -n "$repo" ]; then
+      payload+=",\"repo\":$(_json_string "$repo"),\"branch\":$(_json_string "$branch")"
+    fi
+    payload+="}"
+    curl -fsS --max-time 5 -X POST -H "Content-Type: application/json" --data "$payload" "$endpoint" >/dev/null 2>&1 || true
+  fi
+}
+
+# Set a key in the user's config file, replacing its line or appending one
+# Usage: _config_set <key> <value>
+_config_set() {
+  local key=$1
+  local value=$2
+  local pattern="^[[:space:]]*${key//./\\.}[[:space:]]*="
+
+  mkdir -p "$(dirname "$CONFIG_FILE")" 2>/dev/null || return 1
+  if [ -f "$CONFIG_FILE" ] && grep -qE "$pattern" "$CONFIG_FILE"; then
+    sed -i.bak -E "s|$pattern.*$|$key = $value|" "$CONFIG_FILE" && rm -f "$CONFIG_FILE.bak"
+  else
+    echo "$key = $value" >>"$CONFIG_FILE"
+  fi
+}
+
+# Show, enable or disable telemetry
+# Usage: cmd_telemetry [status|enable|disable]
+cmd_telemetry() {
+  local action=${1:-status}
+  local value=true
+  local endpoint
+  local runs_file="$STATE_DIR/telemetry/runs.tsv"
+
+  case $action in
+  enable | disable)
+    if [ "$action" = disable ]; then
+      value=false
+    fi
+    if ! _config_set telemetry.enabled "$value"; then
+      print_error "Failed to update $CONFIG_FILE"
+      return 1
+    fi
+    if [ "$(_config_get telemetry.enabled false)" != "$value" ]; then
+      print_warning "telemetry.enabled is set by the distribution policy, which wins over $CONFIG_FILE"
+    fi
+    print_status "Telemetry ${action}d in $CONFIG_FILE"
+    ;;
+  status)
+    endpoint=$(_config_get telemetry.endpoint)
+    echo "Telemetry:      $([ "$(_config_get telemetry.enabled false)" = true ] && echo enabled || echo disabled)"
+    echo "Endpoint:       ${endpoint:-none (local only)}"
+    echo "Include names:  $(_config_get telemetry.include_names false)"
+    echo "Local records:  $runs_file ($([ -f "$runs_file" ] && wc -l <"$runs_file" | tr -d ' ' || echo 0) runs)"
+    ;;
+  *)
+    print_error "Unknown telemetry command: $action"
+    echo "Use telemetry --help to see available commands"
+    return 1
+    ;;
+  esac
+}
+
+# Print a completion script for a shell. The scripts complete subcommands and option names,
+# and call back into this script (the hidden __complete command, see _complete) for values
+# that depend on the account and repository: -R, -m, --devcontainer-path and the branch
+# options (-b, --stack-on, --base).
+# Usage: cmd_completion <bash|zsh|fish|powershell>
+cmd_completion() {
+  local shell=${1:-}
+
+  case $shell in
+  bash | zsh)
+    if [ "$shell" = zsh ]; then
+      echo "autoload -U +X bashcompinit && bashcompinit"
+    fi
+    cat <<'EOF'
+_create_codespace_and_checkout() {
+  local cur=${COMP_WORDS[COMP_CWORD]}
+  local prev=${COMP_WORDS[COMP_CWORD - 1]}
+  local repo=""
+  local kind
+  local i
+  local IFS=$'\n'
+
+  for ((i = 1; i < COMP_CWORD - 1; i++)); do
+    if [ "${COMP_WORDS[i]}" = -R ]; then
+      repo=${COMP_WORDS[i + 1]}
+    fi
+  done
+  case $prev in
+  -R) kind=repos ;;
+  -m) kind=machines ;;
+  --devcontainer-path) kind=devcontainers ;;
+  -b | --stack-on | --base) kind=branches ;;
+  *)
+    if [[ "$cur" == -* ]]; then
+      kind=options
+    elif [ "$COMP_CWORD" -eq 1 ]; then
+      kind=commands
+    else
+      return 0
+    fi
+    ;;
+  esac
+  COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]/#\~/$HOME}" __complete "$kind" "$repo" 2>/dev/null)" -- "$cur"))
+}
+complete -F _create_codespace_and_checkout create-codespace-and-checkout create-codespace-and-checkout.sh ./create-codespace-and-checkout.sh
+EOF
+    ;;
+  fish)
+    cat <<'EOF'
+function __create_codespace_and_checkout_complete
+    set -l tokens (commandline -opc)
+    set -l repo ""
+    for i in (seq 2 (math (count $tokens) - 1))
+        if test "$tokens[$i]" = -R
+            set repo $tokens[(math $i + 1)]
+        end
+    end
+    $tokens[1] __complete $argv[1] "$repo" 2>/dev/null
+end
+
+for command in create-codespace-and-checkout create-codespace-and-checkout.sh
+    complete -c $command -f
+    complete -c $command -n __fish_use_subcommand -a '(__create_codespace_and_checkout_complete commands)'
+    complete -c $command -n 'string match -q -- "-*" (commandline -ct)' -a '(__create_codespace_and_checkout_complete options)'
+    complete -c $command -s R -x -a '(__create_codespace_and_checkout_complete repos)'
+    complete -c $command -s m -x -a '(__create_codespace_and_checkout_complete machines)'
+    complete -c $command -l devcontainer-path -x -a '(__create_codespace_and_checkout_complete devcontainers)'
+    complete -c $command -s b -x -a '(__create_codespace_and_checkout_complete branches)'
+    complete -c $command -l stack-on -x -a '(__create_codespace_and_checkout_complete branches)'
+    complete -c $command -l base -x -a '(__create_codespace_and_checkout_complete branches)'
+end
+EOF
+    ;;
+  powershell)
+    cat <<'EOF'
+Register-ArgumentCompleter -Native -CommandName create-codespace-and-checkout, create-codespace-and-checkout.sh -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    $repo = ''
+    for ($i = 1; $i -lt $words.Count - 1; $i++) {
+        if ($words[$i] -eq '-R') { $repo = $words[$i + 1] }
+    }
+    $prev = if ($wordToComplete) { $words[-2] } else { $words[-1] }
+    $kind = switch ($prev) {
+        '-R' { 'repos' }
+        '-m' { 'machines' }
+        '--devcontainer-path' { 'devcontainers' }
+        { $_ -in '-b', '--stack-on', '--base' } { 'branches' }
+        default {
+            if ($wordToComplete -like '-*') { 'options' }
+            elseif ($words.Count -le 2) { 'commands' }
+        }
+    }
+    if (-not $kind) { return }
+    $script = (Get-Command $words[0]).Source
+    & bash $script __complete $kind $repo 2>$null | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+EOF
+    ;;
+  *)
+    print_error "Unsupported shell '${shell}' (expected bash, zsh, fish or powershell)"
+    echo "Use completion --help to see available options"
+    return 1
+    ;;
+  esac
+}
+
+# Print the candidates for a completion: subcommands, option names, or values looked up for
+# the account (repos) or for <repo>, else the repository of the current directory (machines,
+# devcontainers, branches). Lookups that fail print nothing, so the shell falls back to no suggestions.
+# Usage: _complete <commands|options|repos|machines|devcontainers|branches> [repo]
+_complete() {
+  local kind=$1
+  local repo=${2:-}
+
+  case $kind in
+  machines | devcontainers | branches)
+    if [ -z "$repo" ]; then
+      repo=$(_detect_repo) || repo=$DIST_DEFAULT_REPO
+    fi
+    REPO=$repo
+    _split_repo_host >/dev/null 2>&1 || return 0
+    repo=$REPO
+    ;;
+  esac
+
+  case $kind in
+  commands)
+    printf '%s\n' exec-all batch wait status worktree resume history monitor telemetry stats completion version upgrade doctor
+    ;;
+  options)
+    (show_help) | sed -nE 's/^  (-[^ ,]+(, -[^ ]+)?) .*/\1/p' | tr ',' '\n' | tr -d ' '
+    ;;
+  repos)
+    _fetch_repositories
+    ;;
+  machines)
+    _fetch_machine_types "$repo" | cut -f1
+    ;;
+  devcontainers)
+    if _fetch_devcontainers "$repo"; then
+      printf '%s\n' "${DEVCONTAINER_PATHS[@]}"
+    fi
+    ;;
+  branches)
+    _cached_branches "$repo"
+    ;;
+  esac
+}
+
+# Print the remote branches of a repository like _fetch_branches, cached for a few minutes in
+# $STATE_DIR/cache so completing a long branch name doesn't query the API on every tab press
+# Usage: _cached_branches <repo>
+_cached_branches() {
+  local repo=$1
+  local cache_dir="$STATE_DIR/cache/branches"
+  local cache_file
+  local branches
+
+  cache_file="$cache_dir/${GH_HOST:-github.com}_${repo//\//_}"
+  if [ -s "$cache_file" ] && [ -n "$(find "$cache_file" -mmin -"$BRANCH_CACHE_MINUTES" 2>/dev/null)" ]; then
+    cat "$cache_file"
+    return 0
+  fi
+  branches=$(_fetch_branches "$repo")
+  if [ -n "$branches" ] && mkdir -p "$cache_dir" 2>/dev/null; then
+    echo "$branches" >"$cache_file"
+  fi
+  [ -n "$branches" ] && echo "$branches"
+}
+
+# The commit the script was built from: stamped by the release workflow, or looked up when
+# the script runs from a git checkout
+# Usage: _script_commit
+_script_commit() {
+  if [ -n "$SCRIPT_COMMIT" ]; then
+    echo "$SCRIPT_COMMIT"
+  elif ! git -C "$(dirname "${BASH_SOURCE[0]}")" rev-parse --short HEAD 2>/dev/null; then
+    echo "unknown"
+  fi
+}
+
+# Print the version and build metadata of this script and the versions of the tools it runs
+# Usage: cmd_version
+cmd_version() {
+  local gh_version="not installed"
+
+  if command -v "$GH" >/dev/null 2>&1; then
+    gh_version=$("$GH" --version 2>&1 | head -n 1)
+    gh_version=${gh_version#gh version }
+  fi
+  echo "$DIST_NAME $SCRIPT_VERSION"
+  echo "commit: $(_script_commit)"
+  echo "built:  ${SCRIPT_BUILD_DATE:-unknown}"
+  echo "gh:     $gh_version"
+  echo "bash:   $BASH_VERSION"
+}
+
+# Print the SHA-256 checksum of a file
+# Usage: _sha256 <file>
+_sha256() {
+  if command -v sha256sum >/dev/null 2>&1; then
+    sha256sum "$1" | cut -d' ' -f1
+  else
+    shasum -a 256 "$1" | cut -d' ' -f1
+  fi
+}
+
+# Replace this script with the latest release of DIST_RELEASE_REPO after verifying the
+# checksum published with it. The release asset is the script itself, so there is one
+# download for every OS and architecture.
+# Usage: cmd_upgrade [--check] [--force]
+cmd_upgrade() {
+  local check=false
+  local force=false
+  local host=${DIST_RELEASE_REPO%%/*}
+  local release_repo=${DIST_RELEASE_REPO#*/}
+  local latest
+  local target
+  local download_dir
+  local expected
+  local actual
+
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --check)
+      check=true
+      shift
+      ;;
+    --force)
+      force=true
+      shift
+      ;;
+    *)
+      print_error "Unexpected argument: $1"
+      echo "Use upgrade --help to see available options"
+      return 1
+      ;;
+    esac
+  done
+
+  if ! latest=$(_with_timeout "$GH" api --hostname "$host" "repos/$release_repo/releases/latest" --jq .tag_name 2>&1) || [ -z "$latest" ]; then
+    print_error "Could not look up the latest release of $release_repo on $host"
+    print_error "$latest"
+    return 1
+  fi
+  if [ "$latest" = "$SCRIPT_VERSION" ] && [ "$force" = false ]; then
+    print_status "Already up to date ($SCRIPT_VERSION)"
+    return 0
+  fi
+  print_status "Latest release: $latest (installed: $SCRIPT_VERSION)"
+  if [ "$check" = true ]; then
+    return 0
+  fi
+
+  target="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd -P)/$(basename "${BASH_SOURCE[0]}")"
+  if [ "$force" = false ]; then
+    if [ "$SCRIPT_VERSION" = dev ]; then
+      print_error "$target is a development version; update it with git pull, or pass --force to replace it"
+      return 1
+    fi
+    if [[ "$target" == */mise/installs/* ]]; then
+      print_error "$target was installed with mise; upgrade it with: mise upgrade ubi:${release_repo}"
+      return 1
+    fi
+    if [[ "$PROG" == "gh "* ]]; then
+      print_error "$DIST_NAME is installed as a gh extension; upgrade it with: gh extension upgrade ${PROG#gh }"
+      return 1
+    fi
+  fi
+  if [ ! -w "$target" ] || [ ! -w "$(dirname "$target")" ]; then
+    print_error "No permission to replace $target; rerun the upgrade as a user who can write to it"
+    return 1
+  fi
+
+  # Download next to the script, so the final move replaces it atomically
+  download_dir=$(mktemp -d "$(dirname "$target")/.$DIST_NAME-upgrade.XXXXXX") || return 1
+  if ! _with_timeout "$GH" release download "$latest" -R "$DIST_RELEASE_REPO" -p "$DIST_NAME" -p "$DIST_NAME.sha256" -D "$download_dir" >/dev/null 2>&1; then
+    print_error "Failed to download $DIST_NAME and $DIST_NAME.sha256 from release $latest"
+    rm -rf "$download_dir"
+    return 1
+  fi
+  expected=$(cut -d' ' -f1 "$download_dir/$DIST_NAME.sha256")
+  actual=$(_sha256 "$download_dir/$DIST_NAME")
+  if [ -z "$expected" ] || [ "$expected" != "$actual" ]; then
+    print_error "Checksum mismatch for release $latest (expected ${expected:-none}, got $actual); nothing was changed"
+    rm -rf "$download_dir"
+    return 1
+  fi
+  if ! bash -n "$download_dir/$DIST_NAME" 2>/dev/null; then
+    print_error "The downloaded script for $latest does not parse; nothing was changed"
+    rm -rf "$download_dir"
+    return 1
+  fi
+
+  chmod +x "$download_dir/$DIST_NAME"
+  if ! mv -f "$download_dir/$DIST_NAME" "$target"; then
+    print_error "Failed to replace $target"
+    rm -rf "$download_dir"
+    return 1
+  fi
+  rm -rf "$download_dir"
+  print_status "Upgraded $target from $SCRIPT_VERSION to $latest"
+}
+
+# Check the local environment and print a table of results with the fix for each problem:
+# Bash and gh versions, mise and gum, the gh login and token scopes, infocmp, whether the
+# Codespaces API can be reached and the syntax of the config file
+# Usage: cmd_doctor
+cmd_doctor() {
+  local host=${GH_HOST:-$DIST_DEFAULT_HOST}
+  local api_url="https://api.github.com"
+  local gh_version
+  local scopes
+  local http_code
+  local bad_lines
+  local failed=0
+  local row
+  local check
+  local result
+  local detail
+  local -a rows=()
+
+  if [ $# -gt 0 ]; then
+    print_error "Unexpected argument: $1"
+    echo "Use doctor --help to see available options"
+    return 1
+  fi
+  if [ "$host" != github.com ]; then
+    api_url="https://$host/api/v3"
+  fi
+
+  if [ "${BASH_VERSINFO[0]}" -ge 4 ]; then
+    rows+=("bash"$'\t'"ok"$'\t'"$BASH_VERSION")
+  else
+    rows+=("bash"$'\t'"FAIL"$'\t'"$BASH_VERSION; install Bash 4 or newer (macOS: brew install bash)")
+  fi
+
+  if ! command -v "$GH" >/dev/null 2>&1; then
+    rows+=("gh"$'\t'"FAIL"$'\t'"not on PATH; install it from https://cli.github.com")
+  else
+    gh_version=$("$GH" --version 2>/dev/null | head -n 1 | sed -n 's/^gh version \([0-9.]*\).*/\1/p')
+    if [ -n "$gh_version" ] && [ "$(printf '%s\n' "$MIN_GH_VERSION" "$gh_version" | sort -t. -k1,1n -k2,2n -k3,3n | head -n 1)" = "$MIN_GH_VERSION" ]; then
+      rows+=("gh"$'\t'"ok"$'\t'"$gh_version")
+    else
+      rows+=("gh"$'\t'"FAIL"$'\t'"${gh_version:-unknown version}; version $MIN_GH_VERSION or newer is needed, upgrade gh")
+    fi
+
+    if ! scopes=$(_token_scopes "$host"); then
+      rows+=("auth"$'\t'"FAIL"$'\t'"not logged in to $host; run: gh auth login --hostname $host --scopes codespace")
+    elif [ "$scopes" = "-" ]; then
+      rows+=("auth"$'\t'"ok"$'\t'"logged in to $host (the token doesn't report scopes)")
+    elif [[ ",${scopes// /}," != *,codespace,* ]]; then
+      rows+=("auth"$'\t'"FAIL"$'\t'"the token lacks the codespace scope; run: gh auth refresh --hostname $host --scopes codespace")
+    else
+      rows+=("auth"$'\t'"ok"$'\t'"logged in to $host with scopes: $scopes")
+    fi
+  fi
+
+  if ! command -v mise >/dev/null 2>&1; then
+    rows+=("mise"$'\t'"FAIL"$'\t'"not on PATH; install it from https://mise.jdx.dev")
+  elif ! mise x ubi:charmbracelet/gum -- gum --version >/dev/null 2>&1; then
+    rows+=("gum"$'\t'"FAIL"$'\t'"mise could not run gum; check with: mise x ubi:charmbracelet/gum -- gum --version")
+  else
+    rows+=("mise + gum"$'\t'"ok"$'\t'"$(mise x ubi:charmbracelet/gum -- gum --version 2>&1 | head -n 1)")
+  fi
+
+  if command -v infocmp >/dev/null 2>&1; then
+    rows+=("infocmp"$'\t'"ok"$'\t'"terminfo for \$TERM can be uploaded")
+  else
+    rows+=("infocmp"$'\t'"warn"$'\t'"not on PATH; the terminfo upload is skipped (install ncurses to enable it)")
+  fi
+
+  if ! command -v curl >/dev/null 2>&1; then
+    rows+=("network"$'\t'"warn"$'\t'"curl is not on PATH, $api_url was not checked")
+  elif http_code=$(curl -s -o /dev/null --max-time 5 -w '%{http_code}' "$api_url" 2>/dev/null) && [[ "$http_code" =~ ^[1-5][0-9][0-9]$ ]]; then
+    rows+=("network"$'\t'"ok"$'\t'"$api_url answered (HTTP $http_code)")
+  else
+    rows+=("network"$'\t'"FAIL"$'\t'"$api_url could not be reached; check your connection, proxy (HTTPS_PROXY) or VPN")
+  fi
+
+  if [ ! -f "$CONFIG_FILE" ]; then
+    rows+=("config"$'\t'"ok"$'\t'"no config file at $CONFIG_FILE (defaults apply)")
+  else
+    bad_lines=$(grep -nvE '^[[:space:]]*(#.*)?$|^[[:space:]]*[A-Za-z0-9_.-]+[[:space:]]*=' "$CONFIG_FILE" | cut -d: -f1 | paste -sd, -)
+    if [ -n "$bad_lines" ]; then
+      rows+=("config"$'\t'"FAIL"$'\t'"$CONFIG_FILE line(s) $bad_lines are not 'key = value' or a # comment")
+    else
+      rows+=("config"$'\t'"ok"$'\t'"$CONFIG_FILE")
+    fi
+  fi
+
+  printf '%-16s %-8s %s\n' "CHECK" "RESULT" "DETAIL"
+  for row in "${rows[@]}"; do
+    IFS=$'\t' read -r check result detail <<<"$row"
+    printf '%-16s %-8s %s\n' "$check" "$result" "$detail"
+    if [ "$result" = FAIL ]; then
+      failed=$((failed + 1))
+    fi
+  done
+
+  [ "$failed" -eq 0 ]
+}
+
+# Summarize the locally recorded telemetry
+# Usage: cmd_stats
+cmd_stats() {
+  local runs_file="$STATE_DIR/telemetry/runs.tsv"
+
+  if [ $# -gt 0 ]; then
+    print_error "Unexpected argument: $1"
+    echo "Use stats --help to see available options"
+    return 1
+  fi
+  if [ ! -s "$runs_file" ]; then
+    print_warning "No runs recorded yet (telemetry is $([ "$(_config_get telemetry.enabled false)" = true ] && echo enabled || echo "disabled, enable it with: telemetry enable"))"
+    return 0
+  fi
+
+  awk -F '\t' '
+    {
+      runs++; result[$2]++; total += $4
+      if ($3 != "") { reasons[$3]++; has_reasons = 1 }
+      n = split($6, used, ","); for (i = 1; i <= n; i++) { features[used[i]]++; has_features = 1 }
+      n = split($7, phases, ","); for (i = 1; i <= n; i++) {
+        split(phases[i], kv, "="); sum[kv[1]] += kv[2]; count[kv[1]]++; has_phases = 1
+        if (kv[2] > max[kv[1]]) max[kv[1]] = kv[2]
+      }
+    }
+    END {
+      printf "Runs: %d (%d complete, %d cancelled), average %ds\n", runs, result["complete"], result["cancelled"], total / runs
+      if (has_reasons) { print "\nCancellation reasons:"; for (r in reasons) printf "  %-24s %d\n", r, reasons[r] }
+      if (has_features) { print "\nFeatures used:"; for (f in features) printf "  %-24s %d\n", f, features[f] }
+      if (has_phases) {
+        print "\nPhase durations:"; printf "  %-24s %8s %8s %8s\n", "PHASE", "RUNS", "AVG", "MAX"
+        for (k in count) printf "  %-24s %8d %7ds %7ds\n", k, count[k], sum[k] / count[k], max[k]
+      }
+    }' "$runs_file"
+}
+
+# Continue the setup of a codespace from the state file of an earlier run that failed, was
+# interrupted or detached: the recorded repository, branch and options are passed on with
+# --codespace, and the steps that already completed are skipped (see _resume_skips)
+# Usage: cmd_resume <codespace> [create options...]
+cmd_resume() {
+  local name=${1:-}
+  local state_file
+  local key value
+  local repo="" branch="" stack_on="" machine="" devcontainer_path="" step="" status=""
+  local args=()
+
+  if [ -z "$name" ] || [[ "$name" == -* ]]; then
+    print_error "No codespace given"
+    echo "Use resume --help to see available options"
+    return 1
+  fi
+  shift
+  state_file="$STATE_DIR/codespaces/$name"
+  if [ ! -f "$state_file" ]; then
+    print_error "No state recorded for codespace '$name' in $STATE_DIR/codespaces"
+    echo "Continue its setup with: $PROG --codespace $name [-b <branch>]"
+    return 1
+  fi
+
+  while IFS='=' read -r key value; do
+    case $key in
+    repo) repo=$value ;;
+    branch) branch=$value ;;
+    stack_on) stack_on=$value ;;
+    machine) machine=$value ;;
+    devcontainer_path) devcontainer_path=$value ;;
+    step) step=$value ;;
+    status) status=$value ;;
+    esac
+  done <"$state_file"
+
+  if [ "$status" = complete ]; then
+    print_warning "Setup of '$name' already completed; running all steps again"
+  else
+    print_status "Resuming setup of '$name' ($status) from the '${step:-create}' step"
+  fi
+  args=(--codespace "$name" -R "$repo" -m "$machine" --devcontainer-path "$devcontainer_path")
+  if [ -n "$branch" ]; then
+    args+=(-b "$branch")
+  fi
+  if [ -n "$stack_on" ]; then
+    args+=(--stack-on "$stack_on")
+  fi
+  exec "${BASH_SOURCE[0]}" "${args[@]}" "$@"
+}
+
+# Append the run to $STATE_DIR/history.tsv, one tab-separated line per create run:
+# started, finished, outcome (complete, detached, cancelled or failed), repository, branch,
+# codespace, machine type, the step the run ended in and the cancellation reason
+# Usage: _history_record <exit_code>
+_history_record() {
+  local exit_code=$1
+  local outcome
+  local step=""
+  local field
+  local -a fields=()
+
+  if [ "$DRY_RUN" = true ]; then
+    return 0
+  fi
+  outcome=$(_run_outcome "$exit_code")
+  if [ "$outcome" != complete ]; then
+    step=${CURRENT_STEP:-setup}
+  fi
+
+  for field in "$RUN_STARTED_UTC" "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" "$outcome" "$REPO" "$BRANCH_NAME" \
+    "${CODESPACE_NAME:-}" "$CODESPACE_SIZE" "$step" "$CANCEL_REASON"; do
+    fields+=("${field//[$'\t\n']/ }")
+  done
+  mkdir -p "$STATE_DIR" 2>/dev/null || return 1
+  (
+    IFS=$'\t'
+    echo "${fields[*]}"
+  ) >>"$STATE_DIR/history.tsv"
+}
+
+# Print how a create run ended: complete, detached, cancelled or failed
+# Usage: _run_outcome <exit_code>
+_run_outcome() {
+  local exit_code=$1
+
+  if [ -n "$CANCEL_REASON" ]; then
+    echo cancelled
+  elif [ "$exit_code" -ne 0 ] && [ "$exit_code" -ne "$EXIT_CONFIG_TIMEOUT" ]; then
+    echo failed
+  elif [ "$DETACH" = true ] && [ -z "$EXISTING_CODESPACE" ]; then
+    echo detached
+  else
+    echo complete
+  fi
+}
+
+# Write the per-step metrics of the run to TIMINGS_OUT as a JSON object, so codespace startup
+# performance can be aggregated across runs: the run's outcome and duration, and for every
+# step its duration in seconds, the number of attempts and its outcome
+# Usage: _write_timings <exit_code>
+_write_timings() {
+  local exit_code=$1
+  local outcome
+  local record
+  local step seconds attempts step_outcome
+  local steps_json=""
+
+  outcome=$(_run_outcome "$exit_code")
+  for record in "${STEP_TIMINGS[@]}"; do
+    IFS=$'\t' read -r step seconds attempts step_outcome <<<"$record"
+    steps_json+="${steps_json:+,}{\"step\":\"$step\",\"seconds\":$seconds,\"attempts\":$attempts,\"outcome\":\"$step_outcome\"}"
+  done
+
+  if ! printf '{"codespace":%s,"repo":%s,"branch":%s,"machine":%s,"started":"%s","finished":"%s","duration_seconds":%d,"outcome":"%s","exit_code":%d,"steps":[%s]}\n' \
+    "$(_json_string "${CODESPACE_NAME:-}")" "$(_json_string "$REPO")" "$(_json_string "$BRANCH_NAME")" \
+    "$(_json_string "$CODESPACE_SIZE")" "$RUN_STARTED_UTC" "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    "$(($(date +%s) - RUN_STARTED_AT))" "$outcome" "$exit_code" "$steps_json" >"$TIMINGS_OUT" 2>/dev/null; then
+    print_warning "Could not write the step timings to $TIMINGS_OUT"
+  fi
+}
+
+# Show the recorded create runs, most recent first
+# Usage: cmd_history [--repo <owner/repo>] [--branch <branch>] [--codespace <name>] [--limit <n>] [--json]
+cmd_history() {
+  local history_file="$STATE_DIR/history.tsv"
+  local repo=""
+  local branch=""
+  local codespace=""
+  local limit=20
+  local json=false
+
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --repo)
+      repo="$2"
+      shift 2
+      ;;
+    --branch)
+      branch="$2"
+      shift 2
+      ;;
+    --codespace)
+      codespace="$2"
+      shift 2
+      ;;
+    --limit)
+      limit="$2"
+      shift 2
+      ;;
+    --json)
+      json=true
+      shift
+      ;;
+    *)
+      print_error "Unexpected argument: $1"
+      echo "Use history --help to see available options"
+      return 1
+      ;;
+    esac
+  done
+  if ! [[ "$limit" =~ ^[0-9]+$ ]]; then
+    print_error "--limit must be a number (got '$limit')"
+    return 1
+  fi
+  if [ ! -s "$history_file" ]; then
+    if [ "$json" = true ]; then
+      echo "[]"
+    else
+      print_warning "No runs recorded yet"
+    fi
+    return 0
+  fi
+
+  # Most recent first; filters compare case-insensitively, like GitHub does for repository names
+  awk -F '\t' -v repo="$repo" -v branch="$branch" -v codespace="$codespace" '
+    (repo == "" || tolower($4) == tolower(repo)) && (branch == "" || $5 == branch) && (codespace == "" || $6 == codespace) { lines[++n] = $0 }
+    END { for (i = n; i > 0; i--) print lines[i] }
+  ' "$history_file" | head -n "$limit" | awk -F '\t' -v json="$json" '
+    function str(v) { gsub(/\\/, "\\\\", v); gsub(/"/, "\\\"", v); return "\"" v "\"" }
+    function opt(v) { return v == "" ? "null" : str(v) }
+    BEGIN { if (json == "true") printf "[" ; else printf "%-20s %-10s %-28s %-24s %-32s %s\n", "STARTED", "OUTCOME", "REPO", "BRANCH", "CODESPACE", "STEP" }
+    {
+      if (json == "true") {
+        printf "%s{\"started\":%s,\"finished\":%s,\"outcome\":%s,\"repo\":%s,\"branch\":%s,\"codespace\":%s,\"machine\":%s,\"step\":%s,\"cancel_reason\":%s}",
+          (NR > 1 ? "," : ""), str($1), str($2), str($3), str($4), opt($5), opt($6), str($7), opt($8), opt($9)
+      } else {
+        step = $8 ($9 != "" ? " (" $9 ")" : "")
+        printf "%-20s %-10s %-28s %-24s %-32s %s\n", $1, $3, $4, ($5 == "" ? "-" : $5), ($6 == "" ? "-" : $6), step
+      }
+    }
+    END { if (json == "true") print "]" }'
+}
+
+# Milliseconds since the epoch (whole seconds on Bash versions without EPOCHREALTIME)
+# Usage: _now_ms
+_now_ms() {
+  local microseconds
+
+  if [ -n "${EPOCHREALTIME:-}" ]; then
+    microseconds=${EPOCHREALTIME//[!0-9]/}
+    echo $((10#$microseconds / 1000))
+  else
+    echo $(($(date +%s) * 1000))
+  fi
+}
+
+# Sleep for a number of milliseconds; nothing when it isn't positive
+# Usage: _sleep_ms <milliseconds>
+_sleep_ms() {
+  if [ "$1" -gt 0 ]; then
+    sleep "$(awk -v ms="$1" 'BEGIN { printf "%.3f", ms / 1000 }')"
+  fi
+}
+
+# Set API_BUDGET_MS, the time between API requests allowed by api.requests_per_minute
+# (default: 60), once per run
+# Usage: _api_budget
+_api_budget() {
+  local requests_per_minute
+
+  if [ -n "$API_BUDGET_MS" ]; then
+    return 0
+  fi
+  requests_per_minute=$(_config_get api.requests_per_minute 60)
+  if ! [[ "$requests_per_minute" =~ ^[1-9][0-9]*$ ]]; then
+    print_warning "Ignoring invalid api.requests_per_minute '$requests_per_minute' (expected a positive whole number)"
+    requests_per_minute=60
+  fi
+  API_BUDGET_MS=$((60000 / requests_per_minute))
+}
+
+# Reserve the next request slot of the api.requests_per_minute budget, which all runs of the
+# tool share (batch runs, --branches, monitor), and print the milliseconds until it. The next
+# free slot is kept in $STATE_DIR/api-schedule and updated under a mkdir lock; a lock that is
+# still held after 5 seconds was left by a killed run and is taken over.
+# Usage: _api_reserve_slot
+_api_reserve_slot() {
+  local schedule="$STATE_DIR/api-schedule"
+  local tries=0
+  local now_ms
+  local slot_ms
+
+  mkdir -p "$STATE_DIR" 2>/dev/null
+  while ! mkdir "$schedule.lock" 2>/dev/null; do
+    if [ "$tries" -ge 100 ]; then
+      rm -rf "$schedule.lock"
+      # Without a writable state directory, runs are only throttled on their own
+      if ! mkdir "$schedule.lock" 2>/dev/null; then
+        echo 0
+        return
+      fi
+      break
+    fi
+    tries=$((tries + 1))
+    sleep 0.05
+  done
+  now_ms=$(_now_ms)
+  slot_ms=$(cat "$schedule" 2>/dev/null)
+  if ! [[ "$slot_ms" =~ ^[0-9]+$ ]] || [ "$slot_ms" -lt "$now_ms" ]; then
+    slot_ms=$now_ms
+  fi
+  echo $((slot_ms + API_BUDGET_MS)) >"$schedule"
+  rmdir "$schedule.lock"
+  echo $((slot_ms - now_ms))
+}
+
+# Shared scheduler for API polls across many codespaces: each call waits until at least
+# <spacing_ms> have passed since the previous request of this run, so its polls are spread
+# over time instead of bursting, and then for a slot of the requests-per-minute budget
+# shared with the other runs of the tool
+# Usage: _throttle [spacing_ms]
+_throttle() {
+  local spacing_ms=${1:-0}
+
+  _sleep_ms $((LAST_API_REQUEST_MS + spacing_ms - $(_now_ms)))
+  _api_budget
+  _sleep_ms "$(_api_reserve_slot)"
+  LAST_API_REQUEST_MS=$(_now_ms)
+}
+
+# Poll the codespaces created by this tool (those with a state file) once and emit events:
+# stopped (the codespace shut down), deleted (it no longer exists, tracking stops) and idle
+# (it has been running for <idle_hours> since it was last used, sent once per use).
+# What was already reported is remembered in $STATE_DIR/monitor/<codespace>.
+# Polls are spaced <spacing_ms> apart by the shared scheduler (_throttle).
+# Usage: _monitor_poll <idle_hours> <spacing_ms>
+_monitor_poll() {
+  local idle_hours=$1
+  local spacing_ms=$2
+  local monitor_dir="$STATE_DIR/monitor"
+  local state_file
+  local name repo output
+  local state last_used idle_minutes
+  local previous_state idle_notified
+
+  mkdir -p "$monitor_dir" 2>/dev/null || return 1
+
+  for state_file in "$STATE_DIR"/codespaces/*; do
+    [ -f "$state_file" ] || continue
+    name=$(basename "$state_file")
+    repo=$(sed -n 's/^repo=//p' "$state_file")
+    previous_state=$(sed -n 's/^state=//p' "$monitor_dir/$name" 2>/dev/null)
+    idle_notified=$(sed -n 's/^idle_notified=//p' "$monitor_dir/$name" 2>/dev/null)
+
+    _throttle "$spacing_ms"
+    if ! output=$(_with_timeout "$GH" api "/user/codespaces/$name" --jq '
+      (.last_used_at // .created_at) as $used |
+      [.state, $used, ((now - ($used | sub("\\.[0-9]+"; "") | fromdateiso8601)) / 60 | floor)] | @tsv' 2>&1); then
+      if [[ "$output" == *"HTTP 404"* ]]; then
+        _notify deleted "$name" "$repo" "Codespace '$name' ($repo) was deleted"
+        rm -f "$state_file" "$monitor_dir/$name"
+      else
+        print_warning "Could not fetch the state of codespace '$name': $output"
+      fi
+      continue
+    fi
+    IFS=$'\t' read -r state last_used idle_minutes <<<"$output"
+
+    if [ "$state" = "Shutdown" ] && [ "$previous_state" != "Shutdown" ]; then
+      _notify stopped "$name" "$repo" "Codespace '$name' ($repo) stopped"
+    fi
+
+    if [ "$state" = "Available" ] && [ "$idle_minutes" -ge $((idle_hours * 60)) ] && [ "$idle_notified" != "$last_used" ]; then
+      _notify idle "$name" "$repo" "Codespace '$name' ($repo) has been running for $((idle_minutes / 60))h since it was last used"
+      idle_notified=$last_used
+    fi
+
+    {
+      echo "state=$state"
+      echo "idle_notified=$idle_notified"
+    } >"$monitor_dir/$name"
+  done
+}
+
+# Watch the codespaces created by this tool and send lifecycle events to the notifier sinks
+# Usage: cmd_monitor [--interval <seconds>] [--idle-hours <hours>] [--once]
+cmd_monitor() {
+  local interval=300
+  local idle_hours
+  local once=false
+  local spacing_ms
+  local count
+
+  idle_hours=$(_config_get monitor.idle_hours 4)
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --interval)
+      interval="$2"
+      shift 2
+      ;;
+    --idle-hours)
+      idle_hours="$2"
+      shift 2
+      ;;
+    --once)
+      once=true
+      shift
+      ;;
+    *)
+      print_error "Unknown option: $1"
+      echo "Use monitor --help to see available options"
+      exit 1
+      ;;
+    esac
+  done
+
+  if ! [[ "$interval" =~ ^[0-9]+$ ]] || ! [[ "$idle_hours" =~ ^[0-9]+$ ]]; then
+    print_error "--interval and --idle-hours must be whole numbers"
+    exit 1
+  fi
+
+  if [ -z "$(_config_get notify.webhook)" ] && [ -z "$(_config_get notify.command)" ]; then
+    print_warning "No notifier sinks configured (notify.webhook, notify.command); events are only printed"
+  fi
+
+  _api_budget
+
+  if [ "$once" = false ]; then
+    print_status "Monitoring codespaces created by this tool every ${interval}s (idle after ${idle_hours}h)..."
+  fi
+  while true; do
+    count=$(find "$STATE_DIR/codespaces" -type f 2>/dev/null | wc -l | tr -d ' ')
+
+    # Time-slice the interval across the codespaces, but never faster than the request budget
+    spacing_ms=$API_BUDGET_MS
+    if [ "$once" = false ] && [ "$count" -gt 0 ] && [ $((interval * 1000 / count)) -gt "$spacing_ms" ]; then
+      spacing_ms=$((interval * 1000 / count))
+    fi
+
+    _monitor_poll "$idle_hours" "$spacing_ms"
+    if [ "$once" = true ]; then
+      return 0
+    fi
+    # With codespaces to poll, the slots already spread the cycle over the interval
+    if [ "$count" -eq 0 ]; then
+      sleep "$interval"
+    fi
+  done
+}
+
+# Check whether something listens on a TCP port inside the codespace
+# Usage: _remote_port_open <port>
+_remote_port_open() {
+  _remote_script 'exec 3<>"/dev/tcp/127.0.0.1/$1"' "$1"
+}
+
+# Wait for conditions on an existing codespace using the workflow wait steps
+# Usage: cmd_wait <codespace> [--for ready|configured|port:<port>|cmd:<command>]...
+cmd_wait() {
+  local condition
+  local port
+  local -a conditions=()
+
+  CODESPACE_NAME=""
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --for)
+      conditions+=("$2")
+      shift 2
+      ;;
+    --workdir)
+      WORKDIR="${2%/}"
+      shift 2
+      ;;
+    -*)
+      print_error "Unknown option: $1"
+      echo "Use wait --help to see available options"
+      exit 1
+      ;;
+    *)
+      if [ -n "$CODESPACE_NAME" ]; then
+        print_error "Unexpected argument: $1"
+        echo "Use wait --help to see available options"
+        exit 1
+      fi
+      CODESPACE_NAME="$1"
+      shift
+      ;;
+    esac
+  done
+
+  if [ -z "$CODESPACE_NAME" ]; then
+    print_error "No codespace given"
+    echo "Use wait --help to see available options"
+    exit 1
+  fi
+
+  if [ ${#conditions[@]} -eq 0 ]; then
+    conditions=(ready)
+  fi
+
+  # The workspace directory is derived from the repository the codespace was created for
+  REPO=$(_with_timeout "$GH" api "/user/codespaces/$CODESPACE_NAME" --jq '.repository.full_name' 2>/dev/null)
+  if [ -z "$REPO" ]; then
+    print_error "Codespace '$CODESPACE_NAME' not found"
+    return 1
+  fi
+  REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+
+  for condition in "${conditions[@]}"; do
+    case $condition in
+    ready)
+      codespace_wait_ready || return 1
+      ;;
+    configured)
+      codespace_wait_configured || return 1
+      ;;
+    dotfiles)
+      codespace_wait_dotfiles || return 1
+      ;;
+    port:*)
+      port=${condition#port:}
+      if ! [[ "$port" =~ ^[0-9]+$ ]]; then
+        print_error "Invalid port in condition '$condition'"
+        return 1
+      fi
+      if ! retry_until 60 10 "Waiting for port $port" _remote_port_open "$port"; then
+        print_error "Nothing is listening on port $port after 60 attempts"
+        return 1
+      fi
+      print_status "Port $port is open"
+      ;;
+    cmd:*)
+      if [ -z "$WORKSPACE_ROOT" ]; then
+        _find_workspace_dir || true
+      fi
+      if ! retry_until 60 10 "Waiting for '${condition#cmd:}' to succeed" \
+        _remote_script 'cd "$1" || exit 1
+eval "$2"' "$(_command_dir)" "${condition#cmd:}"; then
+        print_error "Command '${condition#cmd:}' did not succeed after 60 attempts"
+        return 1
+      fi
+      print_status "Command '${condition#cmd:}' succeeded"
+      ;;
+    *)
+      print_error "Unknown condition: $condition"
+      echo "Use wait --help to see available conditions"
+      return 1
+      ;;
+    esac
+  done
+}
+
+# Run the readiness checks of the create flow once against an existing codespace and print a
+# diagnostic table: API state, workspace folder, git authentication and configuration
+# Usage: cmd_status <codespace>
+# Returns 1 when any check failed
+cmd_status() {
+  local last_log
+  local available=false
+  local failed=0
+  local row
+  local check
+  local result
+  local detail
+  local -a rows=()
+
+  CODESPACE_NAME=""
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    -*)
+      print_error "Unknown option: $1"
+      echo "Use status --help to see available options"
+      exit 1
+      ;;
+    *)
+      if [ -n "$CODESPACE_NAME" ]; then
+        print_error "Unexpected argument: $1"
+        echo "Use status --help to see available options"
+        exit 1
+      fi
+      CODESPACE_NAME="$1"
+      shift
+      ;;
+    esac
+  done
+
+  if [ -z "$CODESPACE_NAME" ]; then
+    print_error "No codespace given"
+    echo "Use status --help to see available options"
+    exit 1
+  fi
+
+  REPO=$(_with_timeout "$GH" api "/user/codespaces/$CODESPACE_NAME" --jq '.repository.full_name' 2>/dev/null)
+  if [ -z "$REPO" ]; then
+    print_error "Codespace '$CODESPACE_NAME' not found"
+    return 1
+  fi
+  REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+
+  if _check_codespace_available; then
+    available=true
+    rows+=("state"$'\t'"ok"$'\t'"$CODESPACE_STATE")
+  else
+    rows+=("state"$'\t'"FAIL"$'\t'"${CODESPACE_STATE:-unknown}")
+    failed=$((failed + 1))
+  fi
+
+  if [ "$available" = false ]; then
+    rows+=("workspace"$'\t'"skipped"$'\t'"the codespace is not available")
+    rows+=("git auth"$'\t'"skipped"$'\t'"the codespace is not available")
+  elif _find_workspace_dir; then
+    rows+=("workspace"$'\t'"ok"$'\t'"$WORKSPACE_ROOT")
+    codespace_detect_layout >/dev/null 2>&1
+    if _workspace_exec git ls-remote origin HEAD >/dev/null 2>&1; then
+      rows+=("git auth"$'\t'"ok"$'\t'"git ls-remote origin works")
+    else
+      rows+=("git auth"$'\t'"FAIL"$'\t'"git ls-remote origin failed; credentials may not be set up yet")
+      failed=$((failed + 1))
+    fi
+  else
+    rows+=("workspace"$'\t'"FAIL"$'\t'"no /workspaces/$REPO_NAME or devcontainer workspaceFolder")
+    rows+=("git auth"$'\t'"skipped"$'\t'"no workspace folder")
+    failed=$((failed + 2))
+  fi
+
+  last_log=$(_gh cs logs --codespace "$CODESPACE_NAME" 2>/dev/null | tail -n 1 | tr -d '\r')
+  if [[ "$last_log" == *"Finished configuring codespace."* ]]; then
+    rows+=("configuration"$'\t'"ok"$'\t'"finished")
+  else
+    rows+=("configuration"$'\t'"FAIL"$'\t'"not finished; last log line: ${last_log:-none}")
+    failed=$((failed + 1))
+  fi
+
+  printf '%-16s %-8s %s\n' "CHECK" "RESULT" "DETAIL"
+  for row in "${rows[@]}"; do
+    IFS=$'\t' read -r check result detail <<<"$row"
+    printf '%-16s %-8s %s\n' "$check" "$result" "$detail"
+  done
+
+  [ "$failed" -eq 0 ]
+}
+
+# List, add or remove the worktrees created with --worktree in an existing codespace
+# Usage: cmd_worktree <codespace> [list | add <branch> [--base <ref>] | remove <branch>|--all [--force]]
+cmd_worktree() {
+  local action=list
+  local branch=""
+  local base=""
+  local all=false
+  local force=false
+  local worktrees
+  local path
+  local failed=0
+  local -a remove_args=()
+
+  CODESPACE_NAME=""
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    --base)
+      base="$2"
+      shift 2
+      ;;
+    --all)
+      all=true
+      shift
+      ;;
+    --force)
+      force=true
+      shift
+      ;;
+    -*)
+      print_error "Unknown option: $1"
+      echo "Use worktree --help to see available options"
+      exit 1
+      ;;
+    *)
+      if [ -z "$CODESPACE_NAME" ]; then
+        CODESPACE_NAME="$1"
+      elif [ "$action" = list ] && [[ "$1" =~ ^(list|add|remove)$ ]]; then
+        action="$1"
+      elif [ -z "$branch" ] && [ "$action" != list ]; then
+        branch="$1"
+      else
+        print_error "Unexpected argument: $1"
+        echo "Use worktree --help to see available options"
+        exit 1
+      fi
+      shift
+      ;;
+    esac
+  done
+
+  if [ -z "$CODESPACE_NAME" ]; then
+    print_error "No codespace given"
+    echo "Use worktree --help to see available options"
+    exit 1
+  fi
+  if [ "$action" = add ] && [ -z "$branch" ]; then
+    print_error "worktree add needs a branch name"
+    exit 1
+  fi
+  if [ "$action" = remove ] && [ -z "$branch" ] && [ "$all" = false ]; then
+    print_error "worktree remove needs a branch name or --all"
+    exit 1
+  fi
+  if [ -n "$branch" ] && ! _validate_branch_name "$branch"; then
+    exit 1
+  fi
+
+  REPO=$(_with_timeout "$GH" api "/user/codespaces/$CODESPACE_NAME" --jq '.repository.full_name' 2>/dev/null)
+  if [ -z "$REPO" ]; then
+    print_error "Codespace '$CODESPACE_NAME' not found"
+    return 1
+  fi
+  REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+  _find_workspace_dir || true
+  codespace_detect_layout
+
+  if [ "$action" = add ]; then
+    codespace_add_worktree "$branch" "$base"
+    return
+  fi
+
+  # Worktrees created by this tool are the ones at /workspaces/<repo>-<branch>
+  if ! worktrees=$(_workspace_exec git worktree list --porcelain 2>/dev/null); then
+    print_error "Failed to list the worktrees in codespace '$CODESPACE_NAME'"
+    return 1
+  fi
+  worktrees=$(tr -d '\r' <<<"$worktrees" | awk -v prefix="${WORKSPACE_ROOT:-/workspaces/$REPO_NAME}-" '
+    /^worktree / { path = substr($0, 10) }
+    /^branch / && index(path, prefix) == 1 { print path "\t" substr($2, 12) }')
+
+  if [ "$action" = list ]; then
+    if [ -z "$worktrees" ]; then
+      print_status "No worktrees created with --worktree in codespace '$CODESPACE_NAME'"
+      return 0
+    fi
+    printf '%-56s %s\n' "WORKTREE" "BRANCH"
+    while IFS=$'\t' read -r path branch; do
+      printf '%-56s %s\n' "$path" "$branch"
+    done <<<"$worktrees"
+    return 0
+  fi
+
+  if [ "$all" = false ]; then
+    path=$(_worktree_path "$branch")
+    if ! grep -qF "$path"$'\t' <<<"$worktrees"; then
+      print_error "No worktree for branch '$branch' at $path"
+      return 1
+    fi
+    worktrees=$path
+  fi
+  if [ "$force" = true ]; then
+    remove_args=(--force)
+  fi
+  while IFS=$'\t' read -r path _; do
+    if [ -z "$path" ]; then
+      continue
+    fi
+    if _workspace_exec git worktree remove "${remove_args[@]}" "$path" >/dev/null 2>&1; then
+      print_status "Removed the worktree at $path"
+    else
+      print_error "Failed to remove the worktree at $path (uncommitted changes? use --force)"
+      failed=$((failed + 1))
+    fi
+  done <<<"$worktrees"
+  _workspace_exec git worktree prune >/dev/null 2>&1
+  [ "$failed" -eq 0 ]
+}
+
+# Set defaults from environment variables or use built-in defaults
+SCRIPT_VERSION="dev"
+# How to invoke the script in help and hints: "gh <name>" when it runs as a gh extension
+# (a gh-<name> executable), else the path it was started with
+PROG=$0
+if [[ "$(basename "$0")" == gh-* ]]; then
+  PROG="gh $(basename "$0")"
+  PROG=${PROG/gh gh-/gh }
+fi
+# Stamped by the release workflow along with SCRIPT_VERSION; see _script_commit for git checkouts
+SCRIPT_COMMIT=""
+SCRIPT_BUILD_DATE=""
+DEFAULT_MACHINE_TYPE="xLargePremiumLinux"
+REPO=${REPO:-}
+CODESPACE_SIZE=${CODESPACE_SIZE:-"$DEFAULT_MACHINE_TYPE"}
+DEVCONTAINER_PATH=${DEVCONTAINER_PATH:-".devcontainer/devcontainer.json"}
+DISPLAY_NAME=${CODESPACE_DISPLAY_NAME:-""}
+DEFAULT_PERMISSIONS=""
+CODESPACE_LOCATION=""
+BRANCH_NAME=""
+STACK_ON=""
+BASE_REF=""
+CHECKOUT_REF=""                 # --ref: tag or commit to check out with a detached HEAD
+WORKTREE=false
+IMMEDIATE_MODE=false
+BUG_REPORT=false
+BUG_REPORT_TRANSCRIPT=""
+AUTO_GC=false
+CLEANUP_ON_FAILURE=false
+DRY_RUN=false
+OPEN_TARGET=none
+SESSION_RECORDING=false
+PERSONALIZATION=true
+TERMINFO=true
+TERMINFO_NAME=""
+TERMINFO_REQUIRED=false
+PULL=true
+PUSH=false
+SPARSE_CHECKOUT=false
+JSON_OUTPUT=false
+PRINT_NAME=false
+# Seconds a single gh call may take before it is stopped (--command-timeout, else timeout.command,
+# default 300), 0 for no limit
+COMMAND_TIMEOUT=""
+# --output ndjson: the event stream format, and the descriptor (stdout) events are written to
+OUTPUT_FORMAT=""
+EVENT_FD=""
+SYNC_DIFF=false
+SYNC_DIFF_PATCH=""
+# --create-pr: open a draft pull request once the new branch is pushed (or created on GitHub
+# for an --issue); see codespace_create_pr
+CREATE_PR=false
+BRANCH_PUSHED=false
+PR_URL=""
+BILLING_OWNER=""
+BILLING_URL=""
+LAST_API_REQUEST_MS=0
+# Time between API requests allowed by api.requests_per_minute; set by _api_budget
+API_BUDGET_MS=""
+# Workspace folder of the codespace (the devcontainer's workspaceFolder); set by _find_workspace_dir
+WORKSPACE_ROOT=""
+# Directory git commands run in; the workspace folder, or a worktree found by codespace_detect_layout
+WORKSPACE_DIR=""
+# Machine-readable reason a run ended early, recorded in the state file, the --json summary
+# and the "cancelled" notification so automation can tell whether a retry makes sense:
+#   user_abort     the user declined a prompt or chose to stop
+#   interrupted    the run received SIGINT or SIGTERM
+#   invalid_input  an option or selection was rejected before the workflow started
+#   policy         a pre-create hook, a Codespaces policy, --require-prebuild or a required
+#                  permissions authorization blocked creation
+#   quota          billing, spending limit or budget problems
+#   timeout        the codespace did not become available in time
+#   failed         a step failed for another reason (platform, network, git)
+CANCEL_REASON=""
+# Exit codes of the create flow, so wrappers can tell which stage went wrong; invalid input and
+# other failures exit with 1, cancelled prompts and interrupts with 130
+EXIT_CREATE_FAILED=10       # pre-create hooks, billing, prebuild, secrets or gh cs create failed
+EXIT_NOT_READY=11           # the codespace or its workspace folder did not become available
+EXIT_FETCH_FAILED=12        # git fetch failed, usually because git authentication wasn't ready
+EXIT_CHECKOUT_FAILED=13     # the branch could not be checked out
+EXIT_CONFIG_FAILED=14       # the codespace failed while configuring
+EXIT_CONFIG_TIMEOUT=15      # setup finished, but configuration did not complete in time
+CONFIG_TIMED_OUT=false
+RUN_COMMANDS=()
+# Workspace subdirectory (--workdir) for commands, hooks and sessions; see _command_dir
+WORKDIR=""
+FORWARD_PORTS=()
+# Raw arguments appended to gh cs create (--create-arg), for gh options this script doesn't wrap
+CREATE_ARGS=()
+# --create-status: let gh cs create --status wait for the Available state instead of polling
+CREATE_STATUS=false
+# --branch-template: pattern for short branch names; see _apply_branch_template
+BRANCH_TEMPLATE=""
+# --issue: the issue the branch is named after, and its title and URL; see _branch_from_issue
+ISSUE_NUMBER=""
+ISSUE_TITLE=""
+ISSUE_URL=""
+# --fork, or the head repository of a --pr from a fork: where the branch lives; see codespace_checkout_fork
+FORK_REPO=""
+# --pr: the pull request whose branch is checked out; see _branch_from_pr
+PR_NUMBER=""
+WAIT_DOTFILES=false
+# --wait: ready returns once the branch is checked out, configured also waits for configuration
+WAIT_UNTIL=configured
+# Extra readiness check run in the workspace folder (--ready-probe, ready.probe); see _run_ready_probe
+READY_PROBE=""
+# Retries of the fetch, checkout and terminfo steps (--step-retries); see _retry_step
+STEP_RETRIES=""
+# --timings-out: file for the per-step metrics; STEP_TIMINGS holds "step<TAB>seconds<TAB>attempts<TAB>outcome"
+# records of the finished steps, see _record_step_timing
+TIMINGS_OUT=""
+# --log-file (or log.auto): debug log of the run, see _start_log_file
+LOG_FILE=""
+# --theme: output color preset, see _apply_theme
+THEME=""
+# --plain: tagged lines without colors, unicode marks or animation; see _print_plain
+PLAIN_OUTPUT=false
+STEP_TIMINGS=()
+STEP_ATTEMPTS=0
+STEP_OUTCOME=ok
+# Set by _gh_api_poll after a rate limit response: the seconds to wait before the next poll,
+# and the seconds added to every later poll interval
+RATE_LIMIT_WAIT=""
+RATE_LIMIT_BACKOFF=0
+API_RESPONSE=""
+LOG_FILTER=""
+NOTIFY_DESKTOP=false
+DELETE_OLDEST=false
+# --require-prebuild: don't start a codespace cold; see _check_prebuild
+REQUIRE_PREBUILD=false
+PREBUILD_STATE=""
+# Branches that each get their own codespace (--branches, --branches-file), created PARALLEL at a time
+MULTI_BRANCHES=()
+BRANCHES_FILE=""
+PARALLEL=3
+# --detach: return after creation and finish the setup in a background run of this script
+DETACH=false
+# Existing codespace whose setup is continued instead of creating one (--codespace)
+EXISTING_CODESPACE=""
+# First step to run for an existing codespace whose earlier run did not complete; see _resume_skips
+RESUME_FROM=""
+# Arguments of the create flow, passed on to the background run started by --detach
+ORIGINAL_ARGS=()
+SECRETS=()
+COPY_SPECS=()
+COST_HOURLY=""
+COST_DAILY=""
+COST_STORAGE_MONTHLY=""
+COST_SO_FAR=""
+COST_IDLE_TIMEOUT_MINUTES=""
+COST_RETENTION_DAYS=""
+LOCAL_DEVCONTAINER_PATH=""
+LOCAL_SPARSE_PATH=""
+QUIET_PROGRESS=false
+HEARTBEAT_MINUTES=5
+PHASE_STARTED_AT=0
+RUN_STARTED_AT=$(date +%s)
+RUN_STARTED_UTC=$(date -u '+%Y-%m-%dT%H:%M:%SZ')
+TELEMETRY_PHASES=()
+LAST_PROGRESS_AT=0
+DRY_RUN_CODESPACE="dry-run-codespace"
+# The gh executable behind every GitHub call (see _gh); CODESPACE_GH swaps in another one,
+# e.g. a scripted fake that replays canned responses to exercise the steps and their error paths
+GH=${CODESPACE_GH:-gh}
+# Oldest gh release with everything the script uses (gh cs logs --follow, gh api --hostname)
+MIN_GH_VERSION="2.40.0"
+# How long the remote branches looked up for shell completion are reused
+BRANCH_CACHE_MINUTES=5
+NO_BRANCH_CHOICE="(default branch, skip checkout)"
+CURRENT_STEP=""
+STATE_DIR="${XDG_STATE_HOME:-$HOME/.local/state}/create-codespace-and-checkout"
+POLICY_FILE=""
+CONFIG_FILE=${CODESPACE_CONFIG:-"${XDG_CONFIG_HOME:-$HOME/.config}/create-codespace-and-checkout/config"}
+
+# Entry point: parse arguments, prompt for missing options and run the workflow steps
+main() {
+  local arg
+  local run_command
+  local copy_spec
+  local local_root
+  local shell_command
+
+  # Trap SIGINT (CTRL-C) and SIGTERM
+  trap cleanup_on_exit SIGINT SIGTERM
+
+  # Subcommands are recognised by the first argument; everything else runs the create flow
+  SUBCOMMAND=""
+  case "${1:-}" in
+  exec-all | batch | wait | status | worktree | resume | history | monitor | telemetry | stats | completion | version | upgrade | doctor | __complete)
+    SUBCOMMAND=$1
+    shift
+    ;;
+  esac
+  ORIGINAL_ARGS=("$@")
+
+  # Check for help option first (before dependency checks)
+  # Arguments after "--" belong to a remote command and are not inspected
+  for arg in "$@"; do
+    if [ "$arg" = "--" ]; then
+      break
+    fi
+    if [ "$arg" = "-h" ] || [ "$arg" = "--help" ]; then
+      case $SUBCOMMAND in
+      exec-all) show_exec_all_help ;;
+      batch) show_batch_help ;;
+      wait) show_wait_help ;;
+      status) show_status_help ;;
+      worktree) show_worktree_help ;;
+      resume) show_resume_help ;;
+      history) show_history_help ;;
+      monitor) show_monitor_help ;;
+      telemetry) show_telemetry_help ;;
+      stats) show_stats_help ;;
+      completion) show_completion_help ;;
+      upgrade) show_upgrade_help ;;
+      doctor) show_doctor_help ;;
+      *) show_help ;;
+      esac
+    fi
+    if [ "$arg" = "--version" ] && [ -z "$SUBCOMMAND" ]; then
+      SUBCOMMAND=version
+    fi
+  done
+
+  # The version is reported without checking dependencies, as it is what a bug report needs first
+  if [ "$SUBCOMMAND" = version ]; then
+    cmd_version
+    exit $?
+  fi
+  # The doctor reports missing dependencies itself
+  if [ "$SUBCOMMAND" = doctor ]; then
+    cmd_doctor "$@"
+    exit $?
+  fi
+
+  # Check for required dependencies
+  MISSING_DEPS=()
+
+  if ! command -v "$GH" >/dev/null 2>&1; then
+    MISSING_DEPS+=("gh")
+  fi
+
+  if ! command -v mise >/dev/null 2>&1; then
+    MISSING_DEPS+=("mise")
+  fi
+
+  if [ ${#MISSING_DEPS[@]} -ne 0 ]; then
+    echo "[ERROR] Missing required dependencies: ${MISSING_DEPS[*]}"
+    exit 1
+  fi
+
+  # Point gh at the distribution's GitHub host unless the user chose one
+  if [ -z "${GH_HOST:-}" ] && [ "$DIST_DEFAULT_HOST" != "github.com" ]; then
+    export GH_HOST="$DIST_DEFAULT_HOST"
+  fi
+  _load_policy
+  if [ "$(_config_get output.plain false)" = true ]; then
+    PLAIN_OUTPUT=true
+  fi
+  _apply_theme
+
+  # Run a subcommand instead of the create flow
+  case $SUBCOMMAND in
+  exec-all)
+    cmd_exec_all "$@"
+    exit $?
+    ;;
+  batch)
+    cmd_batch "$@"
+    exit $?
+    ;;
+  wait)
+    cmd_wait "$@"
+    exit $?
+    ;;
+  status)
+    cmd_status "$@"
+    exit $?
+    ;;
+  worktree)
+    cmd_worktree "$@"
+    exit $?
+    ;;
+  monitor)
+    cmd_monitor "$@"
+    exit $?
+    ;;
+  telemetry)
+    cmd_telemetry "$@"
+    exit $?
+    ;;
+  stats)
+    cmd_stats "$@"
+    exit $?
+    ;;
+  history)
+    cmd_history "$@"
+    exit $?
+    ;;
+  resume)
+    cmd_resume "$@"
+    exit $?
+    ;;
+  completion)
+    cmd_completion "$@"
+    exit $?
+    ;;
+  upgrade)
+    cmd_upgrade "$@"
+    exit $?
+    ;;
+  __complete)
+    _complete "$@"
+    exit 0
+    ;;
+  esac
+
+  # Parse command line arguments
+  while [[ $# -gt 0 ]]; do
+    case $1 in
+    -h | --help)
+      show_help
+      ;;
+    -b)
+      BRANCH_NAME="$2"
+      shift 2
+      ;;
+    -R)
+      REPO="$2"
+      shift 2
+      ;;
+    -m)
+      CODESPACE_SIZE="$2"
+      shift 2
+      ;;
+    -d)
+      DISPLAY_NAME="$2"
+      shift 2
+      ;;
+    --devcontainer-path)
+      DEVCONTAINER_PATH="$2"
+      shift 2
+      ;;
+    --default-permissions)
+      DEFAULT_PERMISSIONS="--default-permissions"
+      shift
+      ;;
+    --stack-on)
+      STACK_ON="$2"
+      shift 2
+      ;;
+    --worktree)
+      WORKTREE=true
+      shift
+      ;;
+    --bug-report)
+      BUG_REPORT=true
+      shift
+      ;;
+    --auto-gc)
+      AUTO_GC=true
+      shift
+      ;;
+    --cleanup-on-failure)
+      CLEANUP_ON_FAILURE=true
+      shift
+      ;;
+    --dry-run)
+      DRY_RUN=true
+      shift
+      ;;
+    --open)
+      case "$2" in
+      vscode | web | jetbrains | ssh | none)
+        OPEN_TARGET="$2"
+        ;;
+      *)
+        print_error "Invalid --open target '$2' (expected vscode, web, jetbrains, ssh or none)"
+        exit 1
+        ;;
+      esac
+      shift 2
+      ;;
+    --connect)
+      OPEN_TARGET=ssh
+      shift
+      ;;
+    --detach)
+      DETACH=true
+      shift
+      ;;
+    --delete-oldest)
+      DELETE_OLDEST=true
+      shift
+      ;;
+    --require-prebuild)
+      REQUIRE_PREBUILD=true
+      shift
+      ;;
+    --branches | --branches=*)
+      if [ "$1" = --branches ]; then
+        IFS=',' read -r -a MULTI_BRANCHES <<<"$2"
+        shift 2
+      else
+        IFS=',' read -r -a MULTI_BRANCHES <<<"${1#--branches=}"
+        shift
+      fi
+      ;;
+    --branches-file | --branches-file=*)
+      if [ "$1" = --branches-file ]; then
+        BRANCHES_FILE="$2"
+        shift 2
+      else
+        BRANCHES_FILE="${1#--branches-file=}"
+        shift
+      fi
+      ;;
+    --parallel | --parallel=*)
+      if [ "$1" = --parallel ]; then
+        PARALLEL="$2"
+        shift 2
+      else
+        PARALLEL="${1#--parallel=}"
+        shift
+      fi
+      ;;
+    --codespace)
+      EXISTING_CODESPACE="$2"
+      IMMEDIATE_MODE=true
+      shift 2
+      ;;
+    --session-recording)
+      SESSION_RECORDING=true
+      shift
+      ;;
+    --location)
+      CODESPACE_LOCATION="$2"
+      shift 2
+      ;;
+    --create-arg)
+      CREATE_ARGS+=("$2")
+      shift 2
+      ;;
+    --create-arg=*)
+      CREATE_ARGS+=("${1#--create-arg=}")
+      shift
+      ;;
+    --create-status)
+      CREATE_STATUS=true
+      shift
+      ;;
+    --branch-template)
+      BRANCH_TEMPLATE="$2"
+      shift 2
+      ;;
+    --fork)
+      FORK_REPO="$2"
+      shift 2
+      ;;
+    --pr)
+      # 1234, #1234 or a pull request URL, which also sets the repository
+      if [[ "$2" =~ ^https?://[^/]+/([^/]+/[^/]+)/pull/([0-9]+)(/.*)?$ ]]; then
+        REPO=${BASH_REMATCH[1]}
+        PR_NUMBER=${BASH_REMATCH[2]}
+      elif [[ "$2" =~ ^#?([0-9]+)$ ]]; then
+        PR_NUMBER=${BASH_REMATCH[1]}
+      else
+        print_error "--pr expects a pull request number or URL (got '$2')"
+        exit 1
+      fi
+      shift 2
+      ;;
+    --issue)
+      # 4321, #4321 or an issue URL, which also sets the repository
+      if [[ "$2" =~ ^https?://[^/]+/([^/]+/[^/]+)/issues/([0-9]+)/?$ ]]; then
+        REPO=${BASH_REMATCH[1]}
+        ISSUE_NUMBER=${BASH_REMATCH[2]}
+      elif [[ "$2" =~ ^#?([0-9]+)$ ]]; then
+        ISSUE_NUMBER=${BASH_REMATCH[1]}
+      else
+        print_error "--issue expects an issue number or URL (got '$2')"
+        exit 1
+      fi
+      shift 2
+      ;;
+    --base | --new-branch-from)
+      BASE_REF="$2"
+      shift 2
+      ;;
+    --ref)
+      CHECKOUT_REF="$2"
+      shift 2
+      ;;
+    --quiet-progress)
+      QUIET_PROGRESS=true
+      shift
+      ;;
+    --wait-dotfiles)
+      WAIT_DOTFILES=true
+      shift
+      ;;
+    --wait | --wait=*)
+      if [ "$1" = --wait ]; then
+        WAIT_UNTIL="$2"
+        shift
+      else
+        WAIT_UNTIL="${1#--wait=}"
+      fi
+      case "$WAIT_UNTIL" in
+      ready | configured) ;;
+      *)
+        print_error "Invalid --wait value '$WAIT_UNTIL' (expected ready or configured)"
+        exit 1
+        ;;
+      esac
+      shift
+      ;;
+    --no-wait)
+      WAIT_UNTIL=ready
+      shift
+      ;;
+    --ready-probe)
+      READY_PROBE="$2"
+      shift 2
+      ;;
+    --step-retries)
+      STEP_RETRIES="$2"
+      shift 2
+      ;;
+    --timings-out | --timings-out=*)
+      if [ "$1" = --timings-out ]; then
+        TIMINGS_OUT="$2"
+        shift 2
+      else
+        TIMINGS_OUT="${1#--timings-out=}"
+        shift
+      fi
+      ;;
+    --log-file | --log-file=*)
+      if [ "$1" = --log-file ]; then
+        LOG_FILE="$2"
+        shift 2
+      else
+        LOG_FILE="${1#--log-file=}"
+        shift
+      fi
+      ;;
+    --plain)
+      PLAIN_OUTPUT=true
+      _apply_theme
+      shift
+      ;;
+    --theme)
+      case "$2" in
+      dark | light)
+        THEME="$2"
+        _apply_theme
+        ;;
+      *)
+        print_error "Invalid --theme '$2' (expected dark or light)"
+        exit 1
+        ;;
+      esac
+      shift 2
+      ;;
+    --log-filter)
+      LOG_FILTER="$2"
+      shift 2
+      ;;
+    --notify)
+      NOTIFY_DESKTOP=true
+      shift
+      ;;
+    --no-personalization)
+      PERSONALIZATION=false
+      shift
+      ;;
+    --terminfo)
+      TERMINFO_NAME="$2"
+      shift 2
+      ;;
+    --no-terminfo)
+      TERMINFO=false
+      shift
+      ;;
+    --terminfo-required)
+      TERMINFO_REQUIRED=true
+      shift
+      ;;
+    --pull)
+      PULL=true
+      shift
+      ;;
+    --no-pull)
+      PULL=false
+      shift
+      ;;
+    --push)
+      PUSH=true
+      shift
+      ;;
+    --create-pr)
+      CREATE_PR=true
+      PUSH=true
+      shift
+      ;;
+    --sparse-checkout)
+      SPARSE_CHECKOUT=true
+      shift
+      ;;
+    --json)
+      JSON_OUTPUT=true
+      shift
+      ;;
+    --print-name)
+      PRINT_NAME=true
+      shift
+      ;;
+    --command-timeout)
+      if ! [[ "$2" =~ ^[0-9]+$ ]]; then
+        print_error "--command-timeout must be a number of seconds (got '$2')"
+        exit 1
+      fi
+      COMMAND_TIMEOUT=$2
+      shift 2
+      ;;
+    --output | --output=*)
+      if [ "$1" = --output ]; then
+        OUTPUT_FORMAT=$2
+        shift 2
+      else
+        OUTPUT_FORMAT=${1#--output=}
+        shift
+      fi
+      if [ "$OUTPUT_FORMAT" != ndjson ]; then
+        print_error "--output must be ndjson (got '$OUTPUT_FORMAT')"
+        exit 1
+      fi
+      ;;
+    --run)
+      RUN_COMMANDS+=("$2")
+      shift 2
+      ;;
+    --workdir)
+      WORKDIR="${2%/}"
+      shift 2
+      ;;
+    --sync-diff)
+      SYNC_DIFF=true
+      shift
+      ;;
+    --secret)
+      _add_secret "$2" "--secret" || exit 1
+      shift 2
+      ;;
+    --secrets-from-file)
+      _read_secrets_file "$2" || exit 1
+      shift 2
+      ;;
+    --forward-ports)
+      if ! [[ "$2" =~ ^[0-9]+(:[0-9]+)?(,[0-9]+(:[0-9]+)?)*$ ]]; then
+        print_error "--forward-ports expects a comma-separated list of <remote>[:<local>] ports, got '$2'"
+        exit 1
+      fi
+      IFS=, read -ra FORWARD_PORTS <<<"$2"
+      shift 2
+      ;;
+    --copy)
+      if [[ "$2" != ?*:?* ]]; then
+        print_error "--copy expects <local-path>:<remote-path>, got '$2'"
+        exit 1
+      fi
+      if [ ! -e "${2%:*}" ]; then
+        print_error "--copy: local path '${2%:*}' does not exist"
+        exit 1
+      fi
+      COPY_SPECS+=("$2")
+      shift 2
+      ;;
+    -x | --immediate)
+      IMMEDIATE_MODE=true
+      shift
+      ;;
+    -*)
+      print_error "Unknown option: $1"
+      echo "Use --help to see available options"
+      exit 1
+      ;;
+    *)
+      # A bare name (no '/') is a branch name, like -b; see _apply_branch_template
+      if [[ "$1" != */* ]] && [[ "$1" != *@* ]] && [ -z "$BRANCH_NAME" ]; then
+        BRANCH_NAME=$1
+      elif ! _parse_branch_url "$1" && ! _parse_repo_ref "$1"; then
+        print_error "Unexpected argument: $1"
+        echo "Use -b <branch> to specify a branch name, or pass a branch URL (https://github.com/owner/repo/tree/branch) or owner/repo@branch"
+        echo "Use --help to see available options"
+        exit 1
+      fi
+      shift
+      ;;
+    esac
+  done
+
+  if [ -z "$COMMAND_TIMEOUT" ]; then
+    COMMAND_TIMEOUT=$(_config_get timeout.command 300)
+    if ! [[ "$COMMAND_TIMEOUT" =~ ^[0-9]+$ ]]; then
+      print_error "timeout.command must be a number of seconds (got '$COMMAND_TIMEOUT')"
+      exit 1
+    fi
+  fi
+
+  if [ -n "$ISSUE_NUMBER" ] && [ -n "$BRANCH_NAME" ] && [ -z "$EXISTING_CODESPACE" ]; then
+    print_error "--issue cannot be combined with -b: the branch is named after the issue"
+    exit 1
+  fi
+  # A continued run (--codespace) gets the pull request's branch and fork with -b and --fork
+  if [ -n "$PR_NUMBER" ] && [ -z "$EXISTING_CODESPACE" ] && { [ -n "$BRANCH_NAME" ] || [ -n "$FORK_REPO" ]; }; then
+    print_error "--pr cannot be combined with -b or --fork: the branch and fork come from the pull request"
+    exit 1
+  fi
+  if [ -n "$FORK_REPO" ] || [ -n "$PR_NUMBER" ]; then
+    if [ -n "$ISSUE_NUMBER" ] || [ -n "$CHECKOUT_REF" ] || [ -n "$STACK_ON" ] || [ -n "$BASE_REF" ] || [ "$WORKTREE" = true ] || [ "$CREATE_PR" = true ]; then
+      print_error "--fork and --pr check out an existing branch and cannot be combined with --issue, --ref, --stack-on, --base, --worktree or --create-pr"
+      exit 1
+    fi
+    if [ ${#MULTI_BRANCHES[@]} -gt 0 ] || [ -n "$BRANCHES_FILE" ]; then
+      print_error "--branches and --branches-file cannot be combined with --fork or --pr"
+      exit 1
+    fi
+  fi
+  if [ -n "$FORK_REPO" ] && ! [[ "$FORK_REPO" =~ ^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$ ]]; then
+    print_error "--fork expects a repository as owner/repo (got '$FORK_REPO')"
+    exit 1
+  fi
+  if [ -n "$CHECKOUT_REF" ]; then
+    if [ -n "$BRANCH_NAME" ] || [ -n "$ISSUE_NUMBER" ] || [ -n "$STACK_ON" ] || [ -n "$BASE_REF" ] || [ "$WORKTREE" = true ]; then
+      print_error "--ref checks out a detached HEAD and cannot be combined with -b, --issue, --stack-on, --base or --worktree"
+      print_warning "To start a new branch from a tag or commit, use -b <branch> --new-branch-from $CHECKOUT_REF"
+      exit 1
+    fi
+    if [ ${#MULTI_BRANCHES[@]} -gt 0 ] || [ -n "$BRANCHES_FILE" ]; then
+      print_error "--branches and --branches-file cannot be combined with --ref"
+      exit 1
+    fi
+    if [ "$CREATE_PR" = true ]; then
+      print_error "--create-pr needs a branch and cannot be combined with --ref"
+      exit 1
+    fi
+    if [[ "$CHECKOUT_REF" == -* ]]; then
+      print_error "Invalid ref '$CHECKOUT_REF'"
+      exit 1
+    fi
+  fi
+
+  if [ -n "$BRANCHES_FILE" ]; then
+    _read_branches_file "$BRANCHES_FILE" || exit 1
+  fi
+
+  # Several branches: every branch is set up by its own run of this script
+  if [ ${#MULTI_BRANCHES[@]} -gt 0 ]; then
+    if [ -n "$BRANCH_NAME" ] || [ -n "$STACK_ON" ] || [ -n "$EXISTING_CODESPACE" ]; then
+      print_error "--branches and --branches-file cannot be combined with -b, --stack-on or --codespace"
+      exit 1
+    fi
+    if [ "$OPEN_TARGET" != none ]; then
+      print_error "--branches and --branches-file cannot be combined with --open or --connect"
+      exit 1
+    fi
+    if [ "$PRINT_NAME" = true ] || [ -n "$OUTPUT_FORMAT" ]; then
+      print_error "--branches and --branches-file cannot be combined with --print-name or --output, use --json"
+      exit 1
+    fi
+    if [ -n "$ISSUE_NUMBER" ]; then
+      print_error "--branches and --branches-file cannot be combined with --issue"
+      exit 1
+    fi
+    if ! [[ "$PARALLEL" =~ ^[1-9][0-9]*$ ]]; then
+      print_error "--parallel must be a positive number (got '$PARALLEL')"
+      exit 1
+    fi
+    _create_branches "${MULTI_BRANCHES[@]}"
+    exit $?
+  fi
+
+  if [ "$(_config_get dotfiles.wait false)" = true ]; then
+    WAIT_DOTFILES=true
+  fi
+  if [ "$(_config_get create.status false)" = true ]; then
+    CREATE_STATUS=true
+  fi
+  if [ -z "$READY_PROBE" ]; then
+    READY_PROBE=$(_config_get ready.probe)
+  fi
+  if [ -n "$STEP_RETRIES" ] && ! [[ "$STEP_RETRIES" =~ ^[0-9]+$ ]]; then
+    print_error "--step-retries must be a number (got '$STEP_RETRIES')"
+    exit 1
+  fi
+  if [ "$WAIT_DOTFILES" = true ] && [ "$WAIT_UNTIL" = ready ]; then
+    print_warning "--wait-dotfiles only applies when waiting for configuration (--wait configured)"
+  fi
+  if [ "$(_config_get prebuild.required false)" = true ]; then
+    REQUIRE_PREBUILD=true
+  fi
+
+  # Organizations can require recording for every session through the config file
+  if [ "$(_config_get session_recording.enabled false)" = true ]; then
+    SESSION_RECORDING=true
+  fi
+  if [ "$SESSION_RECORDING" = true ] && [ "$OPEN_TARGET" != ssh ]; then
+    print_warning "--session-recording only applies to SSH sessions started with --open ssh or --connect"
+  fi
+
+  if [ "$QUIET_PROGRESS" = true ]; then
+    HEARTBEAT_MINUTES=$(_config_get quiet_progress.heartbeat_minutes "$HEARTBEAT_MINUTES")
+  fi
+
+  # Events keep going to the real stdout when a step's output is captured
+  if [ "$OUTPUT_FORMAT" = ndjson ]; then
+    exec {EVENT_FD}>&1
+  fi
+
+  # Dry-run output and timeouts go to fd 3 so they are shown even where command output is
+  # captured or silenced
+  exec 3>&2
+  if [ "$DRY_RUN" = true ]; then
+    print_warning "Dry run: commands are printed, nothing is executed"
+  fi
+
+  # The debug log records the rest of the run, independent of what the console shows
+  if [ -z "$LOG_FILE" ] && [ "$(_config_get log.auto false)" = true ]; then
+    LOG_FILE="$STATE_DIR/logs/run-$(date '+%Y%m%d-%H%M%S')-$$.log"
+  fi
+  if [ -n "$LOG_FILE" ]; then
+    _start_log_file
+  fi
+
+  # Start collecting the transcript; the report is written on any exit (success, failure or interrupt)
+  if [ "$BUG_REPORT" = true ]; then
+    BUG_REPORT_TRANSCRIPT=$(mktemp "${TMPDIR:-/tmp}/codespace-bug-report.XXXXXX")
+  fi
+  trap '_on_exit $?' EXIT
+
+  # An existing codespace already belongs to a repository
+  if [ -n "$EXISTING_CODESPACE" ] && [ -z "$REPO" ]; then
+    if ! REPO=$(_gh api "/user/codespaces/$EXISTING_CODESPACE" --jq .repository.full_name 2>/dev/null) || [ -z "$REPO" ]; then
+      print_error "Codespace '$EXISTING_CODESPACE' not found; pass -R <owner/repo> if it belongs to another host"
+      exit 1
+    fi
+  fi
+
+  # Without -R or REPO, use the repository of the local clone in the current directory
+  if [ -z "$REPO" ]; then
+    if REPO=$(_detect_repo); then
+      print_status "Using repository $REPO (origin remote of the current directory)"
+    else
+      REPO=$DIST_DEFAULT_REPO
+    fi
+  fi
+
+  # Extract repository name from REPO (e.g., "github/github" -> "github")
+  _split_repo_host || exit 1
+  REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+
+  # Preflight: fail with the fix for a missing login or scope before any prompt or API lookup
+  _check_auth || exit 1
+
+  # Interactive mode: prompt for unspecified options unless immediate mode is enabled
+  if [ "$IMMEDIATE_MODE" = false ]; then
+    # Prompt for repository if not specified
+    if [ "$REPO" = "$DIST_DEFAULT_REPO" ]; then
+      REPOSITORIES=$(_fetch_repositories)
+      if [ -n "$REPOSITORIES" ]; then
+        # Offer the default repository first; typing an unlisted owner/repo selects it as-is
+        REPO_INPUT=$({
+          echo "$DIST_DEFAULT_REPO"
+          grep -vxF "$DIST_DEFAULT_REPO" <<<"$REPOSITORIES"
+        } | _gum_filter "Select repository:" "Type to filter or enter owner/repo") || exit 130
+      else
+        # Fallback to text input if API call fails
+        print_warning "Could not fetch repositories from API, using text input"
+        REPO_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Repository: " --placeholder "$DIST_DEFAULT_REPO") || exit 130
+      fi
+      if [ -n "$REPO_INPUT" ]; then
+        REPO="$REPO_INPUT"
+        _split_repo_host || exit 1
+        REPO_NAME=$(echo "$REPO" | cut -d'/' -f2)
+      fi
+    fi
+
+    # Prompt for machine type if not specified
+    if [ "$CODESPACE_SIZE" = "$DEFAULT_MACHINE_TYPE" ]; then
+      MACHINE_TYPES=$(_fetch_machine_types "$REPO")
+      if [ -n "$MACHINE_TYPES" ]; then
+        _parse_machine_types "$MACHINE_TYPES"
+        DEFAULT_DISPLAY_NAME=${DISPLAY_BY_NAME[$DEFAULT_MACHINE_TYPE]}
+
+        SELECTED_DISPLAY_NAME=$(printf '%s\n' "${DISPLAY_NAMES[@]}" | _gum_choose_machine_type "$DEFAULT_DISPLAY_NAME") || exit 130
+        CODESPACE_SIZE=${NAME_BY_DISPLAY[$SELECTED_DISPLAY_NAME]}
+      else
+        # Fallback to text input if API call fails
+        print_warning "Could not fetch machine types from API, using text input"
+        CODESPACE_SIZE_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Machine type: " --placeholder "$DEFAULT_MACHINE_TYPE") || exit 130
+        if [ -n "$CODESPACE_SIZE_INPUT" ]; then
+          CODESPACE_SIZE="$CODESPACE_SIZE_INPUT"
+        fi
+      fi
+    fi
+
+    # Prompt for devcontainer path if not specified, preselecting the configuration
+    # nearest to the current directory when run from a local clone of the repository
+    if [ "$DEVCONTAINER_PATH" = ".devcontainer/devcontainer.json" ]; then
+      if _detect_local_devcontainer; then
+        DEVCONTAINER_PATH=$LOCAL_DEVCONTAINER_PATH
+        print_status "Detected devcontainer configuration for the current directory: $DEVCONTAINER_PATH"
+      fi
+      if _fetch_devcontainers "$REPO"; then
+        if [ ${#DEVCONTAINER_PATHS[@]} -eq 1 ]; then
+          DEVCONTAINER_PATH=${DEVCONTAINER_PATHS[0]}
+          print_status "Using the only devcontainer configuration in $REPO: $DEVCONTAINER_PATH"
+        else
+          DEVCONTAINER_PATH=$(_gum_choose_devcontainer) || exit 130
+        fi
+      else
+        # Fallback to text input if no configurations were discovered
+        print_warning "Could not discover devcontainer configurations from API, using text input"
+        DEVCONTAINER_PATH_INPUT=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Devcontainer path: " --placeholder "$DEVCONTAINER_PATH") || exit 130
+        if [ -n "$DEVCONTAINER_PATH_INPUT" ]; then
+          DEVCONTAINER_PATH="$DEVCONTAINER_PATH_INPUT"
+        fi
+      fi
+    fi
+
+    # Offer to limit the checkout to the monorepo subdirectory the configuration belongs to
+    if [ "$SPARSE_CHECKOUT" = false ] && [ -n "$LOCAL_SPARSE_PATH" ] && [ "$DEVCONTAINER_PATH" = "$LOCAL_DEVCONTAINER_PATH" ] &&
+      mise x ubi:charmbracelet/gum -- gum confirm --default=false "Limit the checkout to $LOCAL_SPARSE_PATH (git sparse-checkout)?"; then
+      SPARSE_CHECKOUT=true
+    fi
+
+    # Prompt for branch name if not specified (optional)
+    # Note: Branch name is prompted before display name so we can use it as default
+    if [ -z "$BRANCH_NAME" ] && [ -z "$ISSUE_NUMBER" ] && [ -z "$CHECKOUT_REF" ] && [ -z "$PR_NUMBER" ]; then
+      BRANCHES=$(_fetch_branches "$REPO")
+      if [ -n "$BRANCHES" ]; then
+        # Pick an existing branch, type a new name, or keep the default branch
+        BRANCH_NAME=$({
+          echo "$NO_BRANCH_CHOICE"
+          echo "$BRANCHES"
+        } | _gum_filter "Select branch:" "Type to filter or enter a new branch name") || exit 130
+        if [ "$BRANCH_NAME" = "$NO_BRANCH_CHOICE" ]; then
+          BRANCH_NAME=""
+        fi
+      else
+        BRANCH_NAME=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Branch name (optional): " --placeholder "Leave empty to skip checkout") || exit 130
+      fi
+    fi
+  fi
+
+  # Without prompts, the configuration nearest to the current directory is the default
+  if [ "$IMMEDIATE_MODE" = true ] && [ "$DEVCONTAINER_PATH" = ".devcontainer/devcontainer.json" ] && _detect_local_devcontainer; then
+    DEVCONTAINER_PATH=$LOCAL_DEVCONTAINER_PATH
+    print_status "Detected devcontainer configuration for the current directory: $DEVCONTAINER_PATH"
+  fi
+
+  # --sparse-checkout uses the subdirectory of the configuration found for the current directory
+  if [ "$SPARSE_CHECKOUT" = true ]; then
+    if [ -z "$LOCAL_SPARSE_PATH" ] && ! _detect_local_devcontainer; then
+      print_warning "--sparse-checkout needs a devcontainer configuration in a subdirectory of a local clone of $REPO; using a full checkout"
+      SPARSE_CHECKOUT=false
+    elif [ -z "$LOCAL_SPARSE_PATH" ] || [ "$DEVCONTAINER_PATH" != "$LOCAL_DEVCONTAINER_PATH" ]; then
+      print_warning "--sparse-checkout only applies to the configuration detected in a subdirectory; using a full checkout"
+      SPARSE_CHECKOUT=false
+    fi
+  fi
+
+  # Capture the local changes up front, so a missing clone fails before anything is created
+  if [ "$SYNC_DIFF" = true ]; then
+    if ! local_root=$(_local_clone_root); then
+      print_error "--sync-diff must be run from inside a local clone of $REPO"
+      exit 1
+    fi
+    SYNC_DIFF_PATCH=$(mktemp "${TMPDIR:-/tmp}/codespace-sync-diff.XXXXXX")
+    git -C "$local_root" diff HEAD --binary >"$SYNC_DIFF_PATCH"
+    if [ ! -s "$SYNC_DIFF_PATCH" ]; then
+      print_warning "--sync-diff: no uncommitted changes in $local_root"
+      rm -f "$SYNC_DIFF_PATCH"
+      SYNC_DIFF_PATCH=""
+    else
+      print_status "--sync-diff: captured uncommitted changes in $(git -C "$local_root" diff HEAD --name-only | wc -l | tr -d ' ') file(s)"
+    fi
+    if [ -n "$(git -C "$local_root" ls-files --others --exclude-standard)" ]; then
+      print_warning "--sync-diff: untracked files are not synced; git add -N them to include them"
+    fi
+  fi
+
+  _check_repo_access || exit 1
+
+  # Machine type, devcontainer and location only matter when a codespace is created
+  if [ -z "$EXISTING_CODESPACE" ]; then
+    # Fail fast (or pick another) when the machine type isn't available for the repository
+    _validate_machine_type || exit 1
+    _validate_devcontainer_path || exit 1
+
+    # Pick the fastest location (--location auto) or warn about a slow one
+    _resolve_location
+  fi
+
+  # A continued run (--codespace) already got the issue's or pull request's branch or the expanded name
+  if [ -z "$EXISTING_CODESPACE" ]; then
+    if [ -n "$ISSUE_NUMBER" ]; then
+      _branch_from_issue || exit 1
+    fi
+    if [ -n "$PR_NUMBER" ]; then
+      _branch_from_pr || exit 1
+    fi
+    # A fork's branch is checked out by the name it has there
+    if [ -z "$FORK_REPO" ]; then
+      _apply_branch_template
+    fi
+  fi
+
+  # Reject branch names git would refuse before any remote command uses them
+  if [ -n "$BRANCH_NAME" ]; then
+    _validate_branch_name "$BRANCH_NAME" || exit 1
+  fi
+  if [ -n "$STACK_ON" ]; then
+    _validate_branch_name "$STACK_ON" || exit 1
+  fi
+
+  # Warn about (and interactively offer to avoid) new branch names already used by open PRs
+  if [ -n "$BRANCH_NAME" ] && [ -z "$EXISTING_CODESPACE" ] && [ -z "$FORK_REPO" ]; then
+    _check_branch_collision
+    _check_stale_branch
+  fi
+
+  # Prompt for display name if not specified (optional)
+  # Default to branch name (truncated to 48 chars) if branch is set
+  if [ "$IMMEDIATE_MODE" = false ] && [ -z "$DISPLAY_NAME" ]; then
+    default_display_name=""
+    if [ -n "$BRANCH_NAME" ]; then
+      default_display_name="${BRANCH_NAME:0:48}"
+    fi
+    DISPLAY_NAME=$(mise x ubi:charmbracelet/gum -- gum input --prompt "Display name (optional): " --value "$default_display_name" --placeholder "Leave empty for auto-generated name") || exit 130
+  fi
+
+  # Auto-set display name from branch name when not specified
+  # This applies to both immediate mode and when branch was provided via -b flag
+  if [ -z "$DISPLAY_NAME" ] && [ -n "$BRANCH_NAME" ]; then
+    DISPLAY_NAME="${BRANCH_NAME:0:48}"
+  fi
+
+  # Branch name is optional - if not provided, skip checkout step
+  # A stacked branch needs a child branch to stack on top of the parent
+  if [ -n "$STACK_ON" ] && [ -z "$BRANCH_NAME" ]; then
+    print_error "--stack-on requires a branch name (-b <branch>)"
+    exit 1
+  fi
+  if [ -n "$BASE_REF" ] && [ -z "$BRANCH_NAME" ]; then
+    print_error "--base requires a branch name (-b <branch>)"
+    exit 1
+  fi
+  if [ -n "$FORK_REPO" ] && [ -z "$BRANCH_NAME" ]; then
+    print_error "--fork requires the name of the fork's branch (-b <branch>)"
+    exit 1
+  fi
+  if [[ "$BASE_REF" == -* ]]; then
+    print_error "Invalid base ref '$BASE_REF'"
+    exit 1
+  fi
+  if [[ "$WORKDIR" == /* || "/$WORKDIR/" == */../* ]]; then
+    print_error "--workdir must be a path inside the repository, like services/foo (got '$WORKDIR')"
+    exit 1
+  fi
+  if [ "$WORKTREE" = true ] && [ -z "$BRANCH_NAME" ]; then
+    print_error "--worktree requires a branch name (-b <branch>)"
+    exit 1
+  fi
+  if [ "$WORKTREE" = true ] && [ -n "$STACK_ON" ]; then
+    print_error "--worktree cannot be combined with --stack-on"
+    exit 1
+  fi
+  if [ "$TERMINFO_REQUIRED" = true ] && { [ "$TERMINFO" = false ] || [ "$PERSONALIZATION" = false ]; }; then
+    print_error "--terminfo-required cannot be combined with --no-terminfo or --no-personalization"
+    exit 1
+  fi
+  if [ "$DETACH" = true ] && [ "$OPEN_TARGET" != none ]; then
+    print_error "--detach cannot be combined with --open or --connect"
+    exit 1
+  fi
+  if [ "$PRINT_NAME" = true ] && [ "$JSON_OUTPUT" = true ]; then
+    print_error "--print-name cannot be combined with --json"
+    exit 1
+  fi
+  if [ -n "$OUTPUT_FORMAT" ] && { [ "$PRINT_NAME" = true ] || [ "$JSON_OUTPUT" = true ]; }; then
+    print_error "--output ndjson cannot be combined with --print-name or --json"
+    exit 1
+  fi
+
+  if [ -n "$EXISTING_CODESPACE" ]; then
+    print_status "Continuing setup of codespace $EXISTING_CODESPACE..."
+    CODESPACE_NAME=$EXISTING_CODESPACE
+    # Pick up where the recorded run stopped
+    if [ -f "$STATE_DIR/codespaces/$CODESPACE_NAME" ] && ! grep -qx 'status=complete' "$STATE_DIR/codespaces/$CODESPACE_NAME"; then
+      RESUME_FROM=$(sed -n 's/^step=//p' "$STATE_DIR/codespaces/$CODESPACE_NAME")
+      if [ -n "$RESUME_FROM" ] && [[ "$TELEMETRY_PHASE_NAMES" != *" $RESUME_FROM "* ]]; then
+        RESUME_FROM=""
+      fi
+    fi
+    _begin_step create
+  else
+    print_status "Starting codespace creation process..."
+
+    # Each step is recorded in the state file so an interrupted run can be picked up later
+    _begin_step pre-create
+    if ! _run_hooks pre-create; then
+      CANCEL_REASON=policy
+      exit "$EXIT_CREATE_FAILED"
+    fi
+    _check_billing || exit "$EXIT_CREATE_FAILED"
+    _check_prebuild || exit "$EXIT_CREATE_FAILED"
+    if [ -n "$ISSUE_NUMBER" ] && [ -n "$BRANCH_NAME" ]; then
+      _link_issue_branch
+    fi
+    if [ ${#SECRETS[@]} -gt 0 ]; then
+      _begin_step secrets
+      codespace_set_secrets || exit "$EXIT_CREATE_FAILED"
+    fi
+    _begin_step create
+    codespace_create || exit "$EXIT_CREATE_FAILED"
+    if [ "$DETACH" = true ]; then
+      codespace_detach
+      exit $?
+    fi
+  fi
+  _run_step wait-ready false codespace_wait_ready
+  _run_step post-ready true _run_hooks post-ready || true
+  for copy_spec in "${COPY_SPECS[@]}"; do
+    _run_step copy true codespace_copy "${copy_spec%:*}" "${copy_spec##*:}" || true
+  done
+  _begin_step layout
+  codespace_detect_layout
+  _run_step fetch false _retry_step fetch codespace_fetch
+  if [ "$PERSONALIZATION" = true ]; then
+    _run_step personalization true codespace_personalize || true
+  fi
+
+  # Checkout the branch (optional - skip if no branch name provided)
+  if [ -n "$BRANCH_NAME" ] && [ -n "$FORK_REPO" ]; then
+    if ! _run_step checkout true _retry_step checkout codespace_checkout_fork "$FORK_REPO" "$BRANCH_NAME"; then
+      print_warning "Codespace will use the default branch"
+      BRANCH_NAME=""
+    fi
+  elif [ -n "$BRANCH_NAME" ] && [ "$WORKTREE" = true ]; then
+    if ! _run_step checkout true _retry_step checkout codespace_add_worktree "$BRANCH_NAME" "$BASE_REF"; then
+      print_warning "Codespace will use the default branch"
+      BRANCH_NAME=""
+    fi
+  elif [ -n "$BRANCH_NAME" ]; then
+    if ! _run_step checkout true _retry_step checkout codespace_checkout "$BRANCH_NAME" "$STACK_ON" "$BASE_REF"; then
+      print_warning "Codespace will use the default branch"
+      BRANCH_NAME=""
+    fi
+  elif [ -n "$CHECKOUT_REF" ]; then
+    if ! _run_step checkout true _retry_step checkout codespace_checkout_ref "$CHECKOUT_REF"; then
+      print_warning "Codespace will use the default branch"
+      CHECKOUT_REF=""
+    fi
+  else
+    _begin_step checkout
+    print_status "No branch name provided, skipping checkout step"
+    print_status "Codespace will use the default branch"
+  fi
+  _run_step post-checkout true _run_hooks post-checkout || true
+  if [ -n "$SYNC_DIFF_PATCH" ]; then
+    _run_step sync-diff true codespace_apply_patch "$SYNC_DIFF_PATCH" || true
+    rm -f "$SYNC_DIFF_PATCH"
+  fi
+  if [ "$CREATE_PR" = true ] && [ -n "$BRANCH_NAME" ]; then
+    _begin_step create-pr
+    codespace_create_pr
+  fi
+
+  if [ "$SPARSE_CHECKOUT" = true ]; then
+    _begin_step sparse-checkout
+    codespace_sparse_checkout "$LOCAL_SPARSE_PATH"
+  fi
+
+  # A failed codespace is fatal; a configuration timeout only warns
+  if [ "$WAIT_UNTIL" = configured ]; then
+    _run_step wait-configured false _wait_configured_step
+  else
+    _begin_step wait-configured
+    print_status "Not waiting for configuration to complete (--wait ready)"
+  fi
+
+  if [ ${#FORWARD_PORTS[@]} -gt 0 ]; then
+    _run_step forward-ports true codespace_forward_ports "${FORWARD_PORTS[@]}" || true
+  fi
+
+  for run_command in "${RUN_COMMANDS[@]}"; do
+    _run_step run true codespace_run "$run_command" || true
+  done
+
+  _begin_step gc
+  codespace_gc "$REPO" "$CODESPACE_NAME" "$AUTO_GC"
+  _state_save "complete"
+
+  if [ -n "$BRANCH_NAME" ]; then
+    print_status "Setup complete! Your codespace is ready with branch '$BRANCH_NAME' checked out."
+    if [ -n "$ISSUE_NUMBER" ]; then
+      print_status "Branch '$BRANCH_NAME' is for issue #$ISSUE_NUMBER${ISSUE_TITLE:+: $ISSUE_TITLE}${ISSUE_URL:+ ($ISSUE_URL)}"
+    fi
+    if [ -n "$PR_URL" ]; then
+      print_status "Draft pull request: $PR_URL"
+    fi
+    if [ -n "$FORK_REPO" ]; then
+      print_status "Branch '$BRANCH_NAME' is from the fork $FORK_REPO${PR_NUMBER:+ (pull request #$PR_NUMBER)}"
+    fi
+  elif [ -n "$CHECKOUT_REF" ]; then
+    print_status "Setup complete! Your codespace is ready with '$CHECKOUT_REF' checked out (detached HEAD)."
+  else
+    print_status "Setup complete! Your codespace is ready with the default branch."
+  fi
+  if [ -n "$WORKDIR" ]; then
+    # The directory is quoted for the remote shell, the whole command for the local one
+    shell_command="cd $(_remote_quote "$(_command_dir)")&& exec \$SHELL -l"
+    print_status "Connect with: gh cs ssh -c $CODESPACE_NAME -- -t '${shell_command//\'/\'\\\'\'}'"
+  else
+    print_status "Connect with: gh cs ssh -c $CODESPACE_NAME"
+  fi
+  if [ "$WAIT_UNTIL" = ready ]; then
+    print_warning "Configuration may still be running; follow it with: gh cs logs -c $CODESPACE_NAME --follow"
+  fi
+  codespace_cost_estimate
+
+  _print_result
+  if [ "$DRY_RUN" = false ]; then
+    _notify complete "$CODESPACE_NAME" "$REPO" "Codespace '$CODESPACE_NAME' for $REPO is ready"
+  fi
+
+  # --print-name promises a single line on stdout, so an SSH session or editor writes to stderr
+  if [ "$PRINT_NAME" = true ]; then
+    codespace_open "$OPEN_TARGET" "$SESSION_RECORDING" >&2
+  else
+    codespace_open "$OPEN_TARGET" "$SESSION_RECORDING"
+  fi
+
+  # The codespace is usable, but wrappers may want to know that configuration was still running
+  if [ "$CONFIG_TIMED_OUT" = true ]; then
+    exit "$EXIT_CONFIG_TIMEOUT"
+  fi
+}
 
-if [ -n "$BRANCH_NAME" ]; then
-  print_status "Setup complete! Your codespace is ready with branch '$BRANCH_NAME' checked out."
-else
-  print_status "Setup complete! Your codespace is ready with the default branch."
+# Only run when executed, so the script can be sourced as a library
+if [[ "${BASH_SOURCE[0]}" == "$0" ]]; then
+  main "$@"
 fi
-print_status "Connect with: gh cs ssh -c $CODESPACE_NAME"
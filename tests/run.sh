@@ -0,0 +1,103 @@
+#!/usr/bin/env bash
+
+# Run the tests: every test_* function in tests/test_*.sh, each in a subshell with its own
+# temporary directory, against tests/fake-gh instead of gh. No codespace is created.
+# Usage: tests/run.sh [filter]
+# Only tests whose name contains <filter> run; exits 1 when a test failed
+
+TESTS_DIR=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+SCRIPT="$TESTS_DIR/../create-codespace-and-checkout.sh"
+export PATH="$TESTS_DIR/bin:$PATH"
+export CODESPACE_GH="$TESTS_DIR/fake-gh"
+
+# Run the script with a fresh config, state and fake gh log in TEST_DIR; sets OUTPUT to its
+# stdout and stderr and STATUS to its exit code
+# Usage: run_script [args...]
+run_script() {
+  STATUS=0
+  OUTPUT=$("$SCRIPT" "$@" </dev/null 2>&1) || STATUS=$?
+}
+
+# Add a fake gh rule (see tests/fake-gh); the output may use printf %b escapes
+# Usage: gh_rule <glob> <exit code> [output] [times]
+gh_rule() {
+  printf '%s\t%s\t%s\t%s\n' "$1" "$2" "${3:-}" "${4:-}" >>"$FAKE_GH_RULES"
+}
+
+# Number of fake gh calls whose logged (%q-quoted) arguments contain a text
+# Usage: gh_calls <text>
+gh_calls() {
+  local count=0
+  local line
+
+  while IFS= read -r line; do
+    if [[ "$line" == *"$1"* ]]; then
+      count=$((count + 1))
+    fi
+  done <"$FAKE_GH_LOG"
+  echo "$count"
+}
+
+# Fail the test with a message unless two values are equal
+# Usage: assert_eq <expected> <actual> <what>
+assert_eq() {
+  if [ "$1" != "$2" ]; then
+    printf '  %s: expected %q, got %q\n' "$3" "$1" "$2"
+    return 1
+  fi
+}
+
+# Fail the test unless the output of the last run_script contains a text
+# Usage: assert_output_contains <text>
+assert_output_contains() {
+  if [[ "$OUTPUT" != *"$1"* ]]; then
+    printf '  output does not contain %q:\n%s\n' "$1" "$(sed 's/^/    /' <<<"$OUTPUT")"
+    return 1
+  fi
+}
+
+# Run one test function with its own temporary directory
+# Usage: _run_test <function>
+_run_test() (
+  TEST_DIR=$(mktemp -d "${TMPDIR:-/tmp}/codespace-test.XXXXXX")
+  trap 'rm -rf "$TEST_DIR"' EXIT
+  export HOME="$TEST_DIR/home"
+  export XDG_CONFIG_HOME="$TEST_DIR/config"
+  export XDG_STATE_HOME="$TEST_DIR/state"
+  export XDG_CACHE_HOME="$TEST_DIR/cache"
+  export CODESPACE_CONFIG="$TEST_DIR/config.ini"
+  export FAKE_GH_LOG="$TEST_DIR/gh.log"
+  export FAKE_GH_RULES="$TEST_DIR/gh.rules"
+  mkdir -p "$HOME"
+  : >"$CODESPACE_CONFIG"
+  : >"$FAKE_GH_LOG"
+  : >"$FAKE_GH_RULES"
+  cd "$TEST_DIR" || exit 1
+  set -e
+  "$1"
+)
+
+passed=0
+failed=0
+for file in "$TESTS_DIR"/test_*.sh; do
+  # shellcheck source=/dev/null
+  source "$file"
+done
+for test in $(declare -F | awk '{ print $3 }' | grep '^test_'); do
+  if [[ "$test" != *"${1:-}"* ]]; then
+    continue
+  fi
+  # Not run as a condition, which would switch off set -e in the test
+  _run_test "$test"
+  if [ $? -eq 0 ]; then
+    echo "ok   $test"
+    passed=$((passed + 1))
+  else
+    echo "FAIL $test"
+    failed=$((failed + 1))
+  fi
+done
+
+echo ""
+echo "$passed passed, $failed failed"
+[ "$failed" -eq 0 ]
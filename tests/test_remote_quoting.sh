@@ -0,0 +1,105 @@
+# Tests that values reach the codespace as the arguments they were, never as shell code: the
+# fake gh runs every remote command in a local bash (FAKE_GH_SSH=local), and the names below
+# are used as arguments, branch names, workspace paths and --workdir subdirectories
+
+HOSTILE_NAMES=(
+  "it's"
+  'say "hi"'
+  'a;touch pwned'
+  '$(touch pwned)'
+  '`touch pwned`'
+  'two  words'
+  $'line\nbreak'
+  '--option'
+  '*'
+  '~root'
+  'back\slash'
+  '$HOME'
+)
+
+# Source the script as a library, with remote commands run locally by the fake gh
+_source_script() {
+  set +e
+  # shellcheck source=/dev/null
+  source "$SCRIPT"
+  set -e
+  GH=$CODESPACE_GH
+  CODESPACE_NAME=fake-codespace-abc123
+  REPO_NAME=r
+  export FAKE_GH_SSH=local
+}
+
+# Fail when a hostile name was run as a command instead of passed on
+_assert_nothing_ran() {
+  if [ -e "$TEST_DIR/pwned" ]; then
+    echo "  a name was run as shell code"
+    return 1
+  fi
+}
+
+test_remote_script_passes_hostile_arguments() {
+  _source_script
+  assert_eq "$(printf '<%s>\n' "${HOSTILE_NAMES[@]}")" \
+    "$(_remote_script 'printf "<%s>\n" "$@"' "${HOSTILE_NAMES[@]}")" "arguments in the codespace"
+  _assert_nothing_ran
+}
+
+test_remote_exec_passes_hostile_arguments() {
+  _source_script
+  assert_eq "$(printf '<%s>\n' "${HOSTILE_NAMES[@]}")" \
+    "$(_remote_exec printf '<%s>\n' "${HOSTILE_NAMES[@]}")" "arguments in the codespace"
+  _assert_nothing_ran
+}
+
+test_workspace_exec_in_hostile_workspace_paths() {
+  local name
+
+  _source_script
+  for name in "${HOSTILE_NAMES[@]}"; do
+    WORKSPACE_DIR="$TEST_DIR/workspaces/$name"
+    mkdir -p "$WORKSPACE_DIR"
+    assert_eq "$WORKSPACE_DIR" "$(_workspace_exec pwd)" "directory of _workspace_exec"
+    assert_eq "<$name>" "$(_workspace_exec printf '<%s>' "$name")" "argument of _workspace_exec"
+  done
+  _assert_nothing_ran
+}
+
+test_checkout_hostile_branch_names() {
+  local name
+
+  _source_script
+  # A git that records its arguments, one %q-quoted call per line, and knows no remote branches
+  mkdir -p "$TEST_DIR/bin"
+  cat >"$TEST_DIR/bin/git" <<'EOF'
+#!/usr/bin/env bash
+printf '%q ' "$@" >>"$GIT_LOG"
+echo >>"$GIT_LOG"
+EOF
+  chmod +x "$TEST_DIR/bin/git"
+  export PATH="$TEST_DIR/bin:$PATH"
+  export GIT_LOG="$TEST_DIR/git.log"
+  WORKSPACE_DIR="$TEST_DIR/workspaces/it's \$(here)"
+  mkdir -p "$WORKSPACE_DIR"
+
+  for name in "${HOSTILE_NAMES[@]}"; do
+    : >"$GIT_LOG"
+    _checkout_or_create_branch "$name" 2>/dev/null
+    assert_eq "$(printf '%q ' ls-remote --heads origin "refs/heads/$name"; echo; printf '%q ' checkout -b "$name"; echo)" \
+      "$(cat "$GIT_LOG")" "git calls for branch $(printf '%q' "$name")"
+  done
+  _assert_nothing_ran
+}
+
+test_run_in_hostile_workdirs() {
+  local name
+
+  _source_script
+  WORKSPACE_DIR="$TEST_DIR/workspaces/r"
+  for name in "${HOSTILE_NAMES[@]}"; do
+    WORKDIR=$name
+    mkdir -p "$WORKSPACE_DIR/$WORKDIR"
+    codespace_run 'pwd >"$OLDPWD/pwd.out"' 2>/dev/null
+    assert_eq "$WORKSPACE_DIR/$name" "$(cat "$TEST_DIR/pwd.out")" "directory of --run with --workdir $(printf '%q' "$name")"
+  done
+  _assert_nothing_ran
+}